@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// HostAddr：主机的附加地址（如业务网卡 service），ansible 连接使用的管理地址仍是 HostReq.IP
+type HostAddr struct {
+	Name string `json:"Name"`
+	IP   string `json:"IP"`
+}
+
+// 管理地址在主机记录 / inventory 中的名字
+const mgmtAddrName = "mgmt"
+
+const maxAddrs = 8
+
+var addrNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// parseIP：IPv4 / IPv6 地址，返回规范写法（IPv4-mapped IPv6 还原成 IPv4），不接受 zone（fe80::1%eth0）
+func parseIP(s string) (string, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return "", fmt.Errorf("invalid ip: %s", s)
+	}
+	return addr.Unmap().String(), nil
+}
+
+// normalizeAddrs：校验管理地址和附加地址，统一成规范写法，保证同一地址的不同写法拿到同一把锁
+func normalizeAddrs(req *HostReq) error {
+	ip, err := parseIP(req.IP)
+	if err != nil {
+		return err
+	}
+	req.IP = ip
+
+	if len(req.Addresses) > maxAddrs {
+		return fmt.Errorf("too many addresses: %d (max %d)", len(req.Addresses), maxAddrs)
+	}
+	seen := map[string]bool{mgmtAddrName: true}
+	for i := range req.Addresses {
+		a := &req.Addresses[i]
+		if !addrNameRe.MatchString(a.Name) {
+			return fmt.Errorf("invalid address name: %q", a.Name)
+		}
+		if seen[a.Name] {
+			return fmt.Errorf("duplicate address name: %s", a.Name)
+		}
+		seen[a.Name] = true
+		if a.IP, err = parseIP(a.IP); err != nil {
+			return fmt.Errorf("address %s: %w", a.Name, err)
+		}
+	}
+	return nil
+}
+
+// addrsField：附加地址在注册表中的存储格式 "service=10.2.0.5,backup=fd00::9"
+func addrsField(addrs []HostAddr) string {
+	parts := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		parts = append(parts, a.Name+"="+a.IP)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseAddrsField：还原附加地址，并补上管理地址
+func parseAddrsField(mgmt, s string) map[string]string {
+	out := map[string]string{}
+	if mgmt != "" {
+		out[mgmtAddrName] = mgmt
+	}
+	for _, kv := range strings.Split(s, ",") {
+		if name, ip, ok := strings.Cut(kv, "="); ok {
+			out[name] = ip
+		}
+	}
+	return out
+}
+
+// matchAddrPrefix：ip_prefix 过滤，支持 CIDR（10.0.0.0/8、fd00::/8）和字符串前缀，任一地址匹配即可
+func matchAddrPrefix(addrs map[string]string, prefix string) bool {
+	p, cidrErr := netip.ParsePrefix(prefix)
+	for _, ip := range addrs {
+		if cidrErr == nil {
+			if addr, err := netip.ParseAddr(ip); err == nil && p.Contains(addr) {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(ip, prefix) {
+			return true
+		}
+	}
+	return false
+}
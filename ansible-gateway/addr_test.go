@@ -0,0 +1,62 @@
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeAddrs(t *testing.T) {
+	tests := []struct {
+		ip    string
+		addrs []HostAddr
+		want  string // 规范化后的 IP 和 addrsField，或错误
+	}{
+		{"10.0.0.1", nil, "10.0.0.1 "},
+		{"FD00:0:0::5", []HostAddr{{"service", "::ffff:10.2.0.5"}}, "fd00::5 service=10.2.0.5"},
+		{"::ffff:10.0.0.1", nil, "10.0.0.1 "},
+		{"fe80::1%eth0", nil, "invalid ip"},
+		{"10.0.0.256", nil, "invalid ip"},
+		{"10.0.0.1", []HostAddr{{"mgmt", "10.0.0.2"}}, "duplicate address name: mgmt"},
+		{"10.0.0.1", []HostAddr{{"svc", "10.0.0.2"}, {"svc", "10.0.0.3"}}, "duplicate address name: svc"},
+		{"10.0.0.1", []HostAddr{{"Service", "10.0.0.2"}}, "invalid address name"},
+		{"10.0.0.1", []HostAddr{{"svc", "host.local"}}, "address svc: invalid ip"},
+		{"10.0.0.1", make([]HostAddr, maxAddrs+1), "too many addresses"},
+	}
+	for _, tt := range tests {
+		req := HostReq{IP: tt.ip, Addresses: tt.addrs}
+		got := ""
+		if err := normalizeAddrs(&req); err != nil {
+			got = err.Error()
+		} else {
+			got = req.IP + " " + addrsField(req.Addresses)
+		}
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("normalizeAddrs(%s, %v) = %q, want %q", tt.ip, tt.addrs, got, tt.want)
+		}
+	}
+}
+
+func TestAddrsField(t *testing.T) {
+	addrs := parseAddrsField("10.0.0.1", addrsField([]HostAddr{{"service", "fd00::5"}, {"backup", "10.2.0.9"}}))
+	want := map[string]string{"mgmt": "10.0.0.1", "service": "fd00::5", "backup": "10.2.0.9"}
+	if !maps.Equal(addrs, want) {
+		t.Fatalf("parseAddrsField = %v", addrs)
+	}
+
+	tests := []struct {
+		prefix string
+		want   bool
+	}{
+		{"fd00::/8", true},
+		{"10.2.0.0/16", true},
+		{"10.3.0.0/16", false},
+		{"10.0.", true},
+		{"192.", false},
+	}
+	for _, tt := range tests {
+		if got := matchAddrPrefix(addrs, tt.prefix); got != tt.want {
+			t.Errorf("matchAddrPrefix(%q) = %v", tt.prefix, got)
+		}
+	}
+}
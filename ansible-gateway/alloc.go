@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 自动分配的序号范围：<prefix>-001 ~ <prefix>-999
+const maxAllocIndex = 999
+
+// AllocReq：POST /v1/host/allocate 的请求，Prefix 即 hostgroup
+type AllocReq struct {
+	ID        string     `json:"ID"`
+	IP        string     `json:"IP"`
+	Prefix    string     `json:"Prefix"`
+	Addresses []HostAddr `json:"Addresses,omitempty"`
+	Token     string     `json:"Token,omitempty"` // verify.mode=token 时为 hex(HMAC(bootstrap_secret, "<prefix>__<ip>"))
+}
+
+// allocIndex：hostname 为 <prefix>-NNN 时返回序号
+func allocIndex(prefix, hostname string) (int, bool) {
+	rest, ok := strings.CutPrefix(hostname, prefix+"-")
+	if !ok || len(rest) != 3 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(rest)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+// allocateHost：POST /v1/host/allocate，为 ID/IP 分配 <prefix>-NNN 中最小的空闲序号并加锁（和 register 相同的锁），
+// 返回分配的 hostname；同一 ID/IP 重复调用返回已分配的 hostname。之后主机用该 hostname 调用 register 完成初始化
+func (a *App) allocateHost(c *gin.Context) {
+	if a.draining.Load() {
+		a.rejectDraining(c)
+		return
+	}
+
+	var in AllocReq
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, 1<<20)).Decode(&in); err != nil {
+		c.String(http.StatusBadRequest, "invalid json")
+		return
+	}
+	if in.ID == "" || in.IP == "" || in.Prefix == "" {
+		c.String(http.StatusBadRequest, "missing id/ip/prefix")
+		return
+	}
+	if !hostnameCharsRe.MatchString(in.Prefix) || strings.HasSuffix(in.Prefix, "-") {
+		c.String(http.StatusBadRequest, "invalid prefix: %s", in.Prefix)
+		return
+	}
+	req := HostReq{ID: in.ID, Hostname: in.Prefix, IP: in.IP, Addresses: in.Addresses, Token: in.Token}
+	if err := normalizeAddrs(&req); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	// 分配出的 hostname 必须符合命名规则，且解析出的 hostgroup 就是 prefix
+	if name, err := a.parseName(req.ID, fmt.Sprintf("%s-%03d", in.Prefix, 1)); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	} else if name.Hostgroup != in.Prefix {
+		c.String(http.StatusBadRequest, "prefix %s does not match naming policy %s (hostgroup=%s)", in.Prefix, name.Policy, name.Hostgroup)
+		return
+	}
+
+	lg := loggerOf(c).With("host_id", req.ID, "ip", req.IP, "hostgroup", in.Prefix)
+	c.Set(ctxLogger, lg)
+	if !authorize(c, req, in.Prefix) {
+		return
+	}
+	// token 模式下 token 按 prefix 计算（分配前主机还不知道自己的 hostname）
+	if err := a.verifyCaller(c.Request, req); err != nil {
+		lg.Warn("verify caller failed", "remote", c.Request.RemoteAddr, "err", err)
+		c.String(http.StatusForbidden, "caller verification failed: "+err.Error())
+		return
+	}
+	audit(c, "allocate")
+
+	// 同一进程内串行分配，减少并发时无谓的加锁冲突；多实例之间由 Lock 保证唯一
+	a.allocMu.Lock()
+	defer a.allocMu.Unlock()
+
+	ctx := c.Request.Context()
+	val := req.ID + "__" + req.IP
+	names, err := a.registry().List(ctx)
+	if err != nil {
+		metricRegistrations.WithLabelValues("registry_error").Inc()
+		lg.Error("registry list failed", "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
+	used := make(map[int]bool)
+	for _, n := range names {
+		idx, ok := allocIndex(in.Prefix, n)
+		if !ok {
+			continue
+		}
+		used[idx] = true
+		// 幂等：这台主机已经分配过
+		if owner, err := a.registry().Owner(ctx, n); err == nil && owner == val {
+			metricRegistrations.WithLabelValues("idempotent").Inc()
+			lg.Info("already allocated", "hostname", n)
+			a.allocated(c, req, n, true)
+			return
+		}
+	}
+
+	for idx := 1; idx <= maxAllocIndex; idx++ {
+		if used[idx] {
+			continue
+		}
+		hostname := fmt.Sprintf("%s-%03d", in.Prefix, idx)
+		name, err := a.parseName(req.ID, hostname)
+		if err != nil {
+			continue
+		}
+		okSet, err := a.registry().Lock(ctx, hostname, val)
+		if err != nil {
+			metricRegistrations.WithLabelValues("registry_error").Inc()
+			lg.Error("registry lock failed", "hostname", hostname, "err", err)
+			c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+			return
+		}
+		if !okSet {
+			// 其它实例刚刚占用
+			continue
+		}
+		metricRegistrations.WithLabelValues("allocated").Inc()
+		req.Hostname = hostname
+		if err := a.registry().Update(ctx, hostname, registrationFields(req, name)); err != nil {
+			lg.Error("registry update failed", "hostname", hostname, "err", err)
+		}
+		lg.Info("allocated", "hostname", hostname)
+		a.recordHistory(ctx, hostname, HistoryEntry{
+			Action: historyRegister, ID: req.ID, IP: req.IP, Hostgroup: in.Prefix,
+			By: credentialOf(c).name(), Reason: "allocate", RequestID: requestIDOf(c),
+		})
+		a.allocated(c, req, hostname, false)
+		return
+	}
+
+	metricRegistrations.WithLabelValues("conflict").Inc()
+	lg.Warn("no free index", "prefix", in.Prefix)
+	c.String(http.StatusConflict, "no free index for prefix %s (001-%03d all taken)", in.Prefix, maxAllocIndex)
+}
+
+// allocated：返回分配结果；token 模式下附带该 hostname 的 bootstrap token，供随后的 register 使用
+func (a *App) allocated(c *gin.Context, req HostReq, hostname string, existing bool) {
+	resp := map[string]any{
+		"ok":       true,
+		"hostname": hostname,
+		"existing": existing,
+	}
+	if v := a.config().Verify; v.Mode == "token" {
+		resp["token"] = bootstrapToken(v.BootstrapSecret, hostname, req.IP)
+	}
+	c.JSON(http.StatusOK, resp)
+}
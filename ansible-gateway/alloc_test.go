@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAllocIndex(t *testing.T) {
+	tests := []struct {
+		prefix, hostname string
+		want             int
+		ok               bool
+	}{
+		{"prod-web", "prod-web-001", 1, true},
+		{"prod-web", "prod-web-999", 999, true},
+		{"prod-web", "prod-web-000", 0, false},
+		{"prod-web", "prod-web-01", 0, false},
+		{"prod-web", "prod-web-0001", 0, false},
+		{"prod-web", "prod-web-abc", 0, false},
+		{"prod-web", "prod-web-ms-001", 0, false},
+		{"prod", "prod-web-001", 0, false},
+		{"prod-web", "test-web-001", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := allocIndex(tt.prefix, tt.hostname)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("allocIndex(%q, %q) = %d, %v; want %d, %v", tt.prefix, tt.hostname, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAllocateHost(t *testing.T) {
+	a, r := newTestApp(t, nil)
+	r.POST("/v1/host/allocate", a.allocateHost)
+	ctx := context.Background()
+	a.registry().Lock(ctx, "prod-web-001", "biz-x__10.0.0.9")
+	a.registry().Lock(ctx, "prod-web-003", "biz-y__10.0.0.8")
+
+	tests := []struct {
+		body string
+		code int
+		want string
+	}{
+		// 取最小的空闲序号
+		{`{"ID":"biz-a","IP":"10.0.0.1","Prefix":"prod-web"}`, http.StatusOK, `"hostname":"prod-web-002"`},
+		// 同一 ID/IP 再次调用：返回已分配的 hostname
+		{`{"ID":"biz-a","IP":"10.0.0.1","Prefix":"prod-web"}`, http.StatusOK, `"existing":true`},
+		{`{"ID":"biz-b","IP":"10.0.0.2","Prefix":"prod-web"}`, http.StatusOK, `"hostname":"prod-web-004"`},
+		{`{"ID":"biz-c","IP":"10.0.0.3"}`, http.StatusBadRequest, "missing id/ip/prefix"},
+		{`{"ID":"biz-c","IP":"10.0.0.3","Prefix":"prod-web-"}`, http.StatusBadRequest, "invalid prefix"},
+		{`{"ID":"biz-c","IP":"10.0.0.3","Prefix":"../web"}`, http.StatusBadRequest, "invalid prefix"},
+	}
+	for _, tt := range tests {
+		w := serve(r, "POST", "/v1/host/allocate", tt.body)
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: code=%d body=%q", tt.body, w.Code, w.Body.String())
+		}
+	}
+	if owner, _ := a.registry().Owner(ctx, "prod-web-002"); owner != "biz-a__10.0.0.1" {
+		t.Fatalf("prod-web-002 owner = %q", owner)
+	}
+}
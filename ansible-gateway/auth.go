@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Credential：一个调用方凭据，Token 与 Secret 二选一
+//   - Token：静态 token，请求带 Authorization: Bearer <token>
+//   - Secret：HMAC 密钥，请求带 X-Gateway-Key / X-Gateway-Timestamp / X-Gateway-Signature
+//
+// IDs / Hostgroups 为允许操作的范围（path.Match 通配，如 "biz-*"），为空表示不限制；
+// Admin 允许调用 /v1/admin 下的管理接口；token_file / secret_file 从文件读取，避免明文写在配置里
+type Credential struct {
+	Name       string   `yaml:"name"`
+	Token      string   `yaml:"token"`
+	TokenFile  string   `yaml:"token_file"`
+	Secret     string   `yaml:"secret"`
+	SecretFile string   `yaml:"secret_file"`
+	IDs        []string `yaml:"ids"`
+	Hostgroups []string `yaml:"hostgroups"`
+	Admin      bool     `yaml:"admin"`
+}
+
+type AuthCfg struct {
+	Credentials []Credential `yaml:"credentials"` // 为空表示不启用认证
+	MaxSkew     string       `yaml:"max_skew"`    // HMAC 时间戳允许的偏差，默认 5m
+}
+
+const (
+	headerKey       = "X-Gateway-Key"
+	headerTimestamp = "X-Gateway-Timestamp"
+	headerSignature = "X-Gateway-Signature"
+
+	ctxCredential = "credential"
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allows：凭据是否允许操作该 ID / hostgroup（未启用认证时 cred 为 nil，全部放行）
+func (cred *Credential) allows(id, hostgroup string) bool {
+	if cred == nil {
+		return true
+	}
+	return matchAny(cred.IDs, id) && matchAny(cred.Hostgroups, hostgroup)
+}
+
+func (cred *Credential) name() string {
+	if cred == nil {
+		return "anonymous"
+	}
+	return cred.Name
+}
+
+// hmacSignature：hex(HMAC-SHA256(secret, METHOD \n URI \n TIMESTAMP \n BODY))，
+// URI 为请求行里的路径加查询串（如 /v1/host/unregister?teardown=true），查询参数也在签名范围内
+func hmacSignature(secret, method, uri, ts string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(m, "%s\n%s\n%s\n", method, uri, ts)
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// authenticate：识别请求使用的凭据
+func (a *App) authenticate(r *http.Request) (*Credential, error) {
+	creds := a.config().Auth.Credentials
+
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for i := range creds {
+			c := &creds[i]
+			if c.Token != "" && subtle.ConstantTimeCompare([]byte(c.Token), []byte(bearer)) == 1 {
+				return c, nil
+			}
+		}
+		return nil, errUnauthorized
+	}
+
+	key := r.Header.Get(headerKey)
+	if key == "" {
+		return nil, errUnauthorized
+	}
+	var cred *Credential
+	for i := range creds {
+		if creds[i].Secret != "" && creds[i].Name == key {
+			cred = &creds[i]
+			break
+		}
+	}
+	if cred == nil {
+		return nil, errUnauthorized
+	}
+
+	ts := r.Header.Get(headerTimestamp)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid %s", errUnauthorized, headerTimestamp)
+	}
+	skew := mustDur(a.config().Auth.MaxSkew, 5*time.Minute)
+	if d := time.Since(time.Unix(sec, 0)); d > skew || d < -skew {
+		return nil, fmt.Errorf("%w: timestamp out of range", errUnauthorized)
+	}
+
+	// 读出 body 参与签名，再放回去给后面的 handler 解析
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	want := hmacSignature(cred.Secret, r.Method, r.URL.RequestURI(), ts, body)
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get(headerSignature))) {
+		return nil, fmt.Errorf("%w: bad signature", errUnauthorized)
+	}
+	return cred, nil
+}
+
+// requireAuth：配置了凭据时，/v1 下的接口都需要认证
+func (a *App) requireAuth(c *gin.Context) {
+	if len(a.config().Auth.Credentials) == 0 {
+		c.Next()
+		return
+	}
+	cred, err := a.authenticate(c.Request)
+	if err != nil {
+		loggerOf(c).Warn("auth failed", "method", c.Request.Method, "path", c.Request.URL.Path, "remote", c.Request.RemoteAddr, "err", err)
+		c.Header("WWW-Authenticate", `Bearer realm="ansible-gateway"`)
+		c.String(http.StatusUnauthorized, err.Error())
+		c.Abort()
+		return
+	}
+	c.Set(ctxCredential, cred)
+	c.Next()
+}
+
+// requireAdmin：管理接口只允许 admin 凭据；未启用认证时没有凭据，一律拒绝（reload 仍可用 SIGHUP）
+func (a *App) requireAdmin(c *gin.Context) {
+	cred := credentialOf(c)
+	if cred == nil {
+		loggerOf(c).Warn("forbidden: admin api requires auth.credentials", "method", c.Request.Method, "path", c.Request.URL.Path)
+		c.String(http.StatusForbidden, "admin api is disabled: configure auth.credentials with an admin credential")
+		c.Abort()
+		return
+	}
+	if !cred.Admin {
+		loggerOf(c).Warn("forbidden: credential is not admin", "credential", cred.name(), "method", c.Request.Method, "path", c.Request.URL.Path)
+		c.String(http.StatusForbidden, "credential %q is not allowed to call admin api", cred.name())
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// credentialOf：当前请求的凭据，未启用认证时为 nil
+func credentialOf(c *gin.Context) *Credential {
+	v, ok := c.Get(ctxCredential)
+	if !ok {
+		return nil
+	}
+	return v.(*Credential)
+}
+
+// authorize：校验凭据是否允许操作该主机，不允许时回 403
+func authorize(c *gin.Context, req HostReq, hostgroup string) bool {
+	cred := credentialOf(c)
+	if cred.allows(req.ID, hostgroup) {
+		return true
+	}
+	loggerOf(c).Warn("forbidden", "credential", cred.name())
+	c.String(http.StatusForbidden, "credential %q is not allowed to manage id=%s hostgroup=%s", cred.name(), req.ID, hostgroup)
+	return false
+}
+
+// audit：记录哪个凭据触发了什么操作（主机字段已由调用方加到请求 logger 上）
+func audit(c *gin.Context, action string) {
+	loggerOf(c).Info("audit", "credential", credentialOf(c).name(), "action", action, "remote", c.Request.RemoteAddr)
+}
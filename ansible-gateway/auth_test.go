@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newAuthRouter：/v1/echo 回显凭据名和 body，/v1/admin/ping 需要 admin
+func newAuthRouter(t *testing.T, creds []Credential) *gin.Engine {
+	t.Helper()
+	a, _ := newTestApp(t, func(cfg *Config) { cfg.Auth.Credentials = creds })
+	r := gin.New()
+	v1 := r.Group("/v1", a.requireAuth)
+	v1.POST("/echo", func(c *gin.Context) {
+		b, _ := io.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, "%s:%s", credentialOf(c).name(), b)
+	})
+	v1.Group("/admin", a.requireAdmin).GET("/ping", func(c *gin.Context) {
+		c.String(http.StatusOK, "pong")
+	})
+	return r
+}
+
+func signedRequest(key, secret, uri, signURI string, ts time.Time, body string) *http.Request {
+	r := httptest.NewRequest("POST", uri, strings.NewReader(body))
+	sec := strconv.FormatInt(ts.Unix(), 10)
+	r.Header.Set(headerKey, key)
+	r.Header.Set(headerTimestamp, sec)
+	r.Header.Set(headerSignature, hmacSignature(secret, "POST", signURI, sec, []byte(body)))
+	return r
+}
+
+func TestAuthenticateHMAC(t *testing.T) {
+	r := newAuthRouter(t, []Credential{{Name: "goods", Secret: "s3cret"}})
+	now := time.Now()
+	uri := "/v1/echo?teardown=true"
+	body := `{"ID":"biz-a"}`
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		code int
+		want string
+	}{
+		{"valid", signedRequest("goods", "s3cret", uri, uri, now, body), http.StatusOK, `goods:{"ID":"biz-a"}`},
+		// 查询参数在签名范围内，只签路径的请求不能改查询串
+		{"query not signed", signedRequest("goods", "s3cret", uri, "/v1/echo", now, body), http.StatusUnauthorized, "bad signature"},
+		{"wrong secret", signedRequest("goods", "other", uri, uri, now, body), http.StatusUnauthorized, "bad signature"},
+		{"unknown key", signedRequest("nobody", "s3cret", uri, uri, now, body), http.StatusUnauthorized, "unauthorized"},
+		{"too old", signedRequest("goods", "s3cret", uri, uri, now.Add(-6*time.Minute), body), http.StatusUnauthorized, "timestamp out of range"},
+		{"too new", signedRequest("goods", "s3cret", uri, uri, now.Add(6*time.Minute), body), http.StatusUnauthorized, "timestamp out of range"},
+		{"within skew", signedRequest("goods", "s3cret", uri, uri, now.Add(-4*time.Minute), body), http.StatusOK, "goods:"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, tt.req)
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: code=%d body=%q", tt.name, w.Code, w.Body.String())
+		}
+	}
+
+	// body 被改过
+	req := signedRequest("goods", "s3cret", uri, uri, now, body)
+	req.Body = io.NopCloser(strings.NewReader(`{"ID":"biz-b"}`))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("tampered body: code=%d", w.Code)
+	}
+
+	req = signedRequest("goods", "s3cret", uri, uri, now, body)
+	req.Header.Set(headerTimestamp, "yesterday")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "invalid "+headerTimestamp) {
+		t.Errorf("invalid timestamp: code=%d body=%q", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthenticateBearer(t *testing.T) {
+	r := newAuthRouter(t, []Credential{{Name: "ops", Token: "tok-ops", Admin: true}, {Name: "goods", Token: "tok-goods"}})
+	tests := []struct {
+		path, auth string
+		code       int
+	}{
+		{"/v1/echo", "Bearer tok-goods", http.StatusOK},
+		{"/v1/echo", "Bearer tok-bad", http.StatusUnauthorized},
+		{"/v1/echo", "", http.StatusUnauthorized},
+		{"/v1/admin/ping", "Bearer tok-ops", http.StatusOK},
+		{"/v1/admin/ping", "Bearer tok-goods", http.StatusForbidden},
+		{"/v1/admin/ping", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		method := "POST"
+		if strings.HasPrefix(tt.path, "/v1/admin") {
+			method = "GET"
+		}
+		req := httptest.NewRequest(method, tt.path, nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s %q: code=%d body=%q", tt.path, tt.auth, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestCredentialAllows(t *testing.T) {
+	cred := &Credential{IDs: []string{"biz-*"}, Hostgroups: []string{"prod-goods-*", "test-goods"}}
+	tests := []struct {
+		cred          *Credential
+		id, hostgroup string
+		want          bool
+	}{
+		{cred, "biz-a", "prod-goods-api", true},
+		{cred, "biz-a", "test-goods", true},
+		{cred, "ops-a", "prod-goods-api", false},
+		{cred, "biz-a", "prod-order-api", false},
+		{cred, "biz-a", "test-goods-api", false},
+		{&Credential{IDs: []string{"biz-a"}}, "biz-a", "anything", true}, // hostgroups 为空不限制
+		{nil, "any", "any", true},                                        // 未启用认证
+	}
+	for _, tt := range tests {
+		if got := tt.cred.allows(tt.id, tt.hostgroup); got != tt.want {
+			t.Errorf("allows(%q, %q) = %v, want %v", tt.id, tt.hostgroup, got, tt.want)
+		}
+	}
+}
+
+func TestRequireAdminWithoutAuth(t *testing.T) {
+	// 未配置凭据：普通接口放行，管理接口一律 403
+	r := newAuthRouter(t, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/v1/echo", strings.NewReader("hi")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("echo: code=%d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/v1/admin/ping", nil))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "admin api is disabled") {
+		t.Fatalf("admin: code=%d body=%q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// batch：同一 hostgroup、同一 playbook（且 extra vars / tags 相同）的若干任务合并成一次 ansible-playbook 运行
+type batch struct {
+	hostgroup string
+	playbook  string
+	jobs      []*Job
+}
+
+// Write：共享输出广播到每个成员任务的日志
+func (b *batch) Write(p []byte) (int, error) {
+	for _, j := range b.jobs {
+		_, _ = j.Write(p)
+	}
+	return len(p), nil
+}
+
+// logf：单台主机的批次沿用任务的 logger；多台时带上 hostgroup 和全部成员任务
+func (b *batch) logf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	logLine(b.logger(), msg)
+	fmt.Fprintf(b, "%s %s\n", time.Now().Format("2006/01/02 15:04:05.000000"), msg)
+}
+
+func (b *batch) logger() *slog.Logger {
+	if len(b.jobs) == 1 {
+		return b.jobs[0].log
+	}
+	ids := make([]string, len(b.jobs))
+	reqs := make([]string, len(b.jobs))
+	for i, j := range b.jobs {
+		ids[i] = j.ID
+		reqs[i] = j.RequestID
+	}
+	return slog.With("hostgroup", b.hostgroup, "jobs", ids, "request_ids", reqs)
+}
+
+// batcher：在 batch_window 时间窗内收集同组注册，窗口到期（或达到 batch_max_hosts）后整体提交
+type batcher struct {
+	submit func(*batch)
+
+	mu       sync.Mutex
+	window   time.Duration
+	maxHosts int
+	pending  map[string]*batch
+}
+
+func newBatcher(cfg AnsibleCfg, submit func(*batch)) *batcher {
+	return &batcher{
+		window:   mustDur(cfg.BatchWindow, 0),
+		maxHosts: cfg.BatchMaxHosts,
+		submit:   submit,
+		pending:  make(map[string]*batch),
+	}
+}
+
+// setConfig：热加载后更新时间窗和单批上限，对之后开始的批次生效
+func (bt *batcher) setConfig(cfg AnsibleCfg) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.window = mustDur(cfg.BatchWindow, 0)
+	bt.maxHosts = cfg.BatchMaxHosts
+}
+
+// add：未开启合并时直接提交单任务批次
+func (bt *batcher) add(j *Job) {
+	bt.mu.Lock()
+	window := bt.window
+	if window <= 0 {
+		bt.mu.Unlock()
+		bt.submit(&batch{hostgroup: j.Hostgroup, playbook: j.Playbook, jobs: []*Job{j}})
+		return
+	}
+
+	key := j.Hostgroup + "\x00" + j.Playbook + "\x00" + varsKey(j.Vars, j.Tags)
+
+	b, ok := bt.pending[key]
+	if !ok {
+		b = &batch{hostgroup: j.Hostgroup, playbook: j.Playbook}
+		bt.pending[key] = b
+		time.AfterFunc(window, func() { bt.flush(key, b) })
+	}
+	b.jobs = append(b.jobs, j)
+	full := bt.maxHosts > 0 && len(b.jobs) >= bt.maxHosts
+	bt.mu.Unlock()
+
+	j.logf("[INFO] waiting for batch: hostgroup=%s, window=%s, hosts=%d", j.Hostgroup, window, len(b.jobs))
+	if full {
+		bt.flush(key, b)
+	}
+}
+
+// flush：窗口到期或批次满员，从 pending 中摘下并提交（只会提交一次）
+func (bt *batcher) flush(key string, b *batch) {
+	bt.mu.Lock()
+	if bt.pending[key] != b {
+		bt.mu.Unlock()
+		return
+	}
+	delete(bt.pending, key)
+	bt.mu.Unlock()
+
+	bt.submit(b)
+}
+
+// submitBatch：批次入队并在后台运行；入队失败时所有成员任务直接失败
+func (a *App) submitBatch(b *batch) {
+	t, err := a.pool.enqueue(b.hostgroup)
+	if err != nil {
+		b.logf("[ERROR] enqueue batch (hostgroup=%s): %v", b.hostgroup, err)
+		for _, j := range b.jobs {
+			a.jobs.finish(j, err)
+		}
+		return
+	}
+	go a.runBatch(b, t)
+}
+
+// runBatch：排队 → 逐台设置主机名 → 合并 inventory 执行一次 playbook → 按 PLAY RECAP 拆分结果
+func (a *App) runBatch(b *batch, t *ticket) {
+	ctx := a.ctx
+	defer a.pool.release(t)
+
+	err := a.pool.wait(ctx, t, func(pos, queued int) {
+		b.logf("[INFO] queued: position %d/%d", pos, queued)
+	})
+	if err != nil {
+		for _, j := range b.jobs {
+			a.jobs.finish(j, err)
+		}
+		return
+	}
+
+	// 主机不可达、稍后自动重试的任务，本次运行结束后重新提交
+	var retry []*Job
+	var delay time.Duration
+	defer func() {
+		if len(retry) > 0 {
+			a.retryLater(b, retry, delay)
+		}
+	}()
+	tryRetry := func(j *Job, err error, unreachable bool) bool {
+		d, ok := a.autoRetry(j, err, unreachable)
+		if ok {
+			retry = append(retry, j)
+			delay = max(delay, d)
+		}
+		return ok
+	}
+
+	// 步骤 1：并发设置主机名，失败的主机不参与后续 playbook；重试时已完成这一步的主机跳过
+	errs := make([]error, len(b.jobs))
+	var wg sync.WaitGroup
+	for i, j := range b.jobs {
+		a.jobs.start(j)
+		if j.snapshot().StartStep == stepPlaybook {
+			continue
+		}
+		a.jobs.update(j, func(j *Job) { j.Step = stepHostname })
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = a.hostnameStep(ctx, j)
+		}()
+	}
+	wg.Wait()
+
+	var ready []*Job
+	for i, j := range b.jobs {
+		if errs[i] != nil {
+			if !tryRetry(j, errs[i], unreachableExit(errs[i])) {
+				a.jobs.finish(j, errs[i])
+			}
+			continue
+		}
+		a.jobs.update(j, func(j *Job) { j.Step = stepPlaybook })
+		ready = append(ready, j)
+	}
+	if len(ready) == 0 {
+		return
+	}
+	b.jobs = ready
+
+	// 多台主机时写合并 inventory，单台沿用任务自己的 inventory
+	inv := ready[0].Inventory
+	if len(ready) > 1 {
+		p, err := writeBatchInventory(a.logDir, b)
+		if err != nil {
+			b.logf("[ERROR] write batch inventory failed: %v", err)
+			for _, j := range ready {
+				a.jobs.finish(j, err)
+			}
+			return
+		}
+		inv = p
+		b.logf("[INFO] batch inventory written: %s (%d hosts)", inv, len(ready))
+		for _, j := range ready {
+			a.jobs.update(j, func(j *Job) { j.Batch = inv })
+		}
+	}
+
+	// 步骤 2：执行 playbook，同时从输出中收集每台主机的结果
+	pw := newPlaybookWriter(b)
+	first := b.jobs[0]
+	runErr := a.playbookStep(ctx, playbookRun{
+		Dir:       first.PlaybookDir,
+		Playbook:  b.playbook,
+		Inventory: inv,
+		Hostgroup: b.hostgroup,
+		Vars:      first.Vars,
+		Tags:      first.Tags,
+		StartAt:   first.StartAtTask,
+	}, pw, b.logf)
+	pw.Close()
+
+	for _, j := range ready {
+		rc, ok := pw.hostRecap(j.IP)
+		tasks := pw.hostTasks(j.IP)
+		a.jobs.update(j, func(j *Job) {
+			if ok {
+				j.Recap = &rc
+			}
+			j.Tasks = tasks
+			j.FailedTask = failedTask(tasks)
+		})
+
+		var err error
+		switch {
+		case ok && (rc.Failed > 0 || rc.Unreachable > 0) && runErr != nil:
+			err = fmt.Errorf("playbook step: host failed (failed=%d, unreachable=%d): %w", rc.Failed, rc.Unreachable, runErr)
+		case ok && (rc.Failed > 0 || rc.Unreachable > 0):
+			err = fmt.Errorf("playbook step: host failed (failed=%d, unreachable=%d)", rc.Failed, rc.Unreachable)
+		case ok:
+			// 批次里其它主机失败导致退出码非 0 时，本机结果以 RECAP 为准
+		case runErr != nil:
+			err = fmt.Errorf("playbook step: %w", runErr)
+		default:
+			err = fmt.Errorf("playbook step: host missing from PLAY RECAP")
+		}
+
+		if ok {
+			j.logf("[INFO] host result: %s", rc)
+		}
+		if err != nil && tryRetry(j, err, ok && rc.Unreachable > 0) {
+			continue
+		}
+		if err != nil {
+			j.logf("[ERROR] %v", err)
+		} else {
+			j.logf("[INFO] initialize host done. log=%s", j.LogPath)
+		}
+		j.logf("[INFO] summary: state=%s %s", stateOf(err), summarizeTasks(tasks))
+		a.jobs.finish(j, err)
+	}
+}
+
+func stateOf(err error) JobState {
+	if errors.Is(err, errShutdown) {
+		return JobInterrupted
+	}
+	if err != nil {
+		return JobFailed
+	}
+	return JobSucceeded
+}
+
+func writeBatchInventory(dir string, b *batch) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("[" + b.hostgroup + "]\n")
+	for _, j := range b.jobs {
+		buf.WriteString(j.IP + "\n")
+	}
+	p := filepath.Join(dir, fmt.Sprintf("batch__%s__%s.txt", b.hostgroup, time.Now().Format("2006-01-02_15:04:05.000000")))
+	return p, os.WriteFile(p, buf.Bytes(), 0o644)
+}
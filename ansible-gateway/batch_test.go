@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAnsible：在 PATH 最前面放假的 ansible / ansible-playbook，playbook 为 ansible-playbook 的脚本内容
+func fakeAnsible(t *testing.T, playbook string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"ansible":          "exit 0",
+		"ansible-playbook": playbook,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func batchJob(id, hostgroup string, vars map[string]any) *Job {
+	j := &Job{ID: id, Hostgroup: hostgroup, Playbook: hostgroup + ".yml", Vars: vars}
+	j.log = jobLogger(j)
+	return j
+}
+
+func TestBatcherMerge(t *testing.T) {
+	submitted := make(chan *batch, 10)
+	bt := newBatcher(AnsibleCfg{BatchWindow: "50ms"}, func(b *batch) { submitted <- b })
+
+	bt.add(batchJob("a1", "prod-web", nil))
+	bt.add(batchJob("a2", "prod-web", nil))
+	bt.add(batchJob("v1", "prod-web", map[string]any{"version": "1.2"})) // extra vars 不同，不合并
+	bt.add(batchJob("b1", "prod-db", nil))
+
+	got := map[string]string{}
+	for range 3 {
+		select {
+		case b := <-submitted:
+			var ids []string
+			for _, j := range b.jobs {
+				ids = append(ids, j.ID)
+			}
+			got[ids[0]] = strings.Join(ids, ",")
+		case <-time.After(2 * time.Second):
+			t.Fatalf("batches not flushed, got %v", got)
+		}
+	}
+	if got["a1"] != "a1,a2" || got["v1"] != "v1" || got["b1"] != "b1" {
+		t.Fatalf("batches = %v", got)
+	}
+	select {
+	case b := <-submitted:
+		t.Fatalf("extra batch: %+v", b)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBatcherMaxHosts(t *testing.T) {
+	submitted := make(chan *batch, 10)
+	bt := newBatcher(AnsibleCfg{BatchWindow: "1h", BatchMaxHosts: 2}, func(b *batch) { submitted <- b })
+
+	bt.add(batchJob("a1", "prod-web", nil))
+	bt.add(batchJob("a2", "prod-web", nil))
+	bt.add(batchJob("a3", "prod-web", nil))
+	// 满员立即提交，第三个进入新的批次等待窗口
+	if b := <-submitted; len(b.jobs) != 2 {
+		t.Fatalf("first batch has %d jobs", len(b.jobs))
+	}
+	if len(submitted) != 0 || len(bt.pending) != 1 {
+		t.Fatalf("submitted=%d pending=%d", len(submitted), len(bt.pending))
+	}
+
+	// 未开启合并：直接提交
+	bt.setConfig(AnsibleCfg{})
+	bt.add(batchJob("b1", "prod-db", nil))
+	if b := <-submitted; len(b.jobs) != 1 || b.jobs[0].ID != "b1" {
+		t.Fatalf("unbatched = %+v", b)
+	}
+}
+
+func TestRunBatchSplitsRecap(t *testing.T) {
+	// 默认回调的 PLAY RECAP：10.0.0.2 失败，10.0.0.3 不在 RECAP 中
+	fakeAnsible(t, `cat <<'EOF'
+PLAY RECAP *********
+10.0.0.1                   : ok=3 changed=1 unreachable=0 failed=0 skipped=0 rescued=0 ignored=0
+10.0.0.2                   : ok=1 changed=0 unreachable=0 failed=1 skipped=0 rescued=0 ignored=0
+EOF
+exit 2`)
+	a, _ := newTestApp(t, func(cfg *Config) { cfg.Ansible.StdoutCallback = "default" })
+
+	b := &batch{hostgroup: "prod-web", playbook: "prod-web.yml"}
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		req := HostReq{ID: "biz-a", Hostname: fmt.Sprintf("prod-web-%03d", i+1), IP: ip}
+		inv := a.inventoryPath(req)
+		if err := os.WriteFile(inv, []byte(hostInventory("prod-web", ip)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		j, err := a.jobs.create(req, HostName{Hostgroup: "prod-web"}, "prod-web.yml", inv, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.jobs = append(b.jobs, j)
+	}
+	jobs := append([]*Job(nil), b.jobs...)
+	tk, _ := a.pool.enqueue(b.hostgroup)
+	a.runBatch(b, tk)
+
+	want := []struct {
+		state JobState
+		recap *HostRecap
+		err   string
+	}{
+		{JobSucceeded, &HostRecap{Ok: 3, Changed: 1}, ""},
+		{JobFailed, &HostRecap{Ok: 1, Failed: 1}, "host failed (failed=1, unreachable=0)"},
+		{JobFailed, nil, "playbook step"},
+	}
+	for i, j := range jobs {
+		snap := j.snapshot()
+		if snap.State != want[i].state || !strings.Contains(snap.Error, want[i].err) {
+			t.Errorf("%s: state=%s err=%q", snap.IP, snap.State, snap.Error)
+		}
+		if (snap.Recap == nil) != (want[i].recap == nil) || (snap.Recap != nil && *snap.Recap != *want[i].recap) {
+			t.Errorf("%s: recap=%v", snap.IP, snap.Recap)
+		}
+		if snap.Batch == "" {
+			t.Errorf("%s: batch inventory not recorded", snap.IP)
+		}
+	}
+	inv, _ := os.ReadFile(jobs[0].snapshot().Batch)
+	if string(inv) != "[prod-web]\n10.0.0.1\n10.0.0.2\n10.0.0.3\n" {
+		t.Errorf("batch inventory = %q", inv)
+	}
+	if a.pool.active() != 0 {
+		t.Errorf("pool slot not released")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// 环境变量覆盖的前缀：ANSIBLE_GATEWAY_<SECTION>_<KEY>，如 ANSIBLE_GATEWAY_REDIS_PASSWORD
+const envPrefix = "ANSIBLE_GATEWAY"
+
+// 配置加载：严格解析（未知字段报错）→ 环境变量覆盖 → 读取 *_file 指向的密钥
+func loadConfig(path string) (Config, error) {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := overrideConfig(&cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// readConfig：读文件并严格解析 YAML。字段类型错误 / 未知字段时返回 *yaml.TypeError，
+// 此时 cfg 中其余字段仍然有效（-check-config 借此继续校验，一次列出全部问题）
+func readConfig(path string) (Config, error) {
+	var cfg Config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("parse config yaml: %w", err)
+	}
+	return cfg, nil
+}
+
+// overrideConfig：环境变量覆盖，再读取 *_file 指向的密钥
+func overrideConfig(cfg *Config) error {
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+		return err
+	}
+	return resolveSecrets(cfg)
+}
+
+// applyEnv：按 yaml 字段名逐级拼出环境变量名，存在则覆盖配置文件中的值；
+// 支持 string / int / bool 和逗号分隔的 []string，auth.credentials 这类结构列表不支持
+func applyEnv(v reflect.Value, prefix string) error {
+	var errs []error
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		f := v.Field(i)
+
+		if f.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(f, name))
+			continue
+		}
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(val)
+		case reflect.Int:
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid int %q", name, val))
+				continue
+			}
+			f.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid bool %q", name, val))
+				continue
+			}
+			f.SetBool(b)
+		case reflect.Slice:
+			if f.Type().Elem().Kind() != reflect.String {
+				errs = append(errs, fmt.Errorf("%s: not supported as environment variable", name))
+				continue
+			}
+			var list []string
+			for _, s := range strings.Split(val, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = append(list, s)
+				}
+			}
+			f.Set(reflect.ValueOf(list))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readSecret：xxx_file 指向的文件内容（去掉首尾空白）作为 xxx 的值，两者不能同时设置
+func readSecret(name string, val *string, file string) error {
+	if file == "" {
+		return nil
+	}
+	if *val != "" {
+		return fmt.Errorf("%s and %s_file are mutually exclusive", name, name)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("%s_file: %w", name, err)
+	}
+	*val = strings.TrimSpace(string(b))
+	return nil
+}
+
+func resolveSecrets(cfg *Config) error {
+	errs := []error{
+		readSecret("redis.password", &cfg.Redis.Password, cfg.Redis.PasswordFile),
+		readSecret("verify.bootstrap_secret", &cfg.Verify.BootstrapSecret, cfg.Verify.BootstrapSecretFile),
+	}
+	for i := range cfg.Auth.Credentials {
+		c := &cfg.Auth.Credentials[i]
+		name := fmt.Sprintf("auth.credentials[%d]", i)
+		errs = append(errs,
+			readSecret(name+".token", &c.Token, c.TokenFile),
+			readSecret(name+".secret", &c.Secret, c.SecretFile),
+		)
+	}
+	for i := range cfg.Notify.Targets {
+		t := &cfg.Notify.Targets[i]
+		name := fmt.Sprintf("notify.targets[%d]", i)
+		errs = append(errs, readSecret(name+".key", &t.Key, t.KeyFile))
+		for h, file := range t.HeaderFiles {
+			if t.Headers == nil {
+				t.Headers = make(map[string]string)
+			}
+			v := t.Headers[h]
+			errs = append(errs, readSecret(name+".headers."+h, &v, file))
+			t.Headers[h] = v
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkConfig：-check-config 模式，加载并校验配置，返回全部问题
+func checkConfig(path string) error {
+	cfg, err := readConfig(path)
+	var typeErr *yaml.TypeError
+	if err != nil && !errors.As(err, &typeErr) {
+		// 文件读不到或 YAML 语法错误，没法继续校验
+		return err
+	}
+	return errors.Join(err, overrideConfig(&cfg), validateConfig(cfg), checkStdoutCallback(cfg.Ansible.StdoutCallback))
+}
+
+// validateConfig：加载后的语义校验，列出全部问题（热加载时校验失败不会替换正在使用的配置）
+func validateConfig(cfg Config) error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.Server.Addr); err != nil {
+		add("server.addr: invalid address %q", cfg.Server.Addr)
+	}
+
+	if cfg.Ansible.Dir == "" {
+		add("ansible.dir is required")
+	} else if fi, err := os.Stat(cfg.Ansible.Dir); err != nil || !fi.IsDir() {
+		add("ansible.dir: %s is not a directory", cfg.Ansible.Dir)
+	}
+	if cfg.Ansible.Log == "" {
+		add("ansible.log is required")
+	}
+	for _, n := range []struct {
+		name string
+		val  int
+	}{
+		{"ansible.max_concurrent", cfg.Ansible.MaxConcurrent},
+		{"ansible.max_per_hostgroup", cfg.Ansible.MaxPerHostgroup},
+		{"ansible.max_queue", cfg.Ansible.MaxQueue},
+		{"ansible.batch_max_hosts", cfg.Ansible.BatchMaxHosts},
+		{"ansible.retry_unreachable", cfg.Ansible.RetryUnreachable},
+	} {
+		if n.val < 0 {
+			add("%s: must not be negative", n.name)
+		}
+	}
+
+	for _, d := range []struct{ name, val string }{
+		{"server.read_timeout", cfg.Server.ReadTimeout},
+		{"server.write_timeout", cfg.Server.WriteTimeout},
+		{"server.idle_timeout", cfg.Server.IdleTimeout},
+		{"server.shutdown_timeout", cfg.Server.ShutdownTimeout},
+		{"ansible.retry_after", cfg.Ansible.RetryAfter},
+		{"ansible.batch_window", cfg.Ansible.BatchWindow},
+		{"ansible.retry_backoff", cfg.Ansible.RetryBackoff},
+		{"lease.ttl", cfg.Lease.TTL},
+		{"lease.reap_interval", cfg.Lease.ReapInterval},
+		{"lease.probe_timeout", cfg.Lease.ProbeTimeout},
+		{"auth.max_skew", cfg.Auth.MaxSkew},
+		{"notify.timeout", cfg.Notify.Timeout},
+		{"notify.retry_backoff", cfg.Notify.RetryBackoff},
+	} {
+		if d.val == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.val); err != nil {
+			add("%s: invalid duration %q", d.name, d.val)
+		} else if v < 0 {
+			add("%s: must not be negative", d.name)
+		}
+	}
+
+	switch cfg.Registry.Backend {
+	case "", "redis":
+		if _, _, err := net.SplitHostPort(cfg.Redis.Addr); err != nil {
+			add("redis.addr: invalid address %q", cfg.Redis.Addr)
+		}
+		if cfg.Redis.DB < 0 {
+			add("redis.db: must not be negative")
+		}
+	case "file", "memory":
+	default:
+		add("registry.backend: unknown backend %q", cfg.Registry.Backend)
+	}
+
+	for i, c := range cfg.Auth.Credentials {
+		if c.Name == "" {
+			add("auth.credentials[%d]: name is required", i)
+		}
+		if (c.Token == "") == (c.Secret == "") {
+			add("auth.credentials[%d]: exactly one of token/secret is required", i)
+		}
+	}
+
+	switch cfg.Verify.Mode {
+	case "", "source":
+	case "token":
+		if cfg.Verify.BootstrapSecret == "" {
+			add("verify.bootstrap_secret is required in token mode")
+		}
+	default:
+		add("verify.mode: unknown mode %q", cfg.Verify.Mode)
+	}
+	if _, err := parsePrefixes(cfg.Verify.TrustedProxies); err != nil {
+		add("verify.trusted_proxies: %v", err)
+	}
+
+	errs = append(errs, validateRequestVars(cfg.Ansible.RequestVars)...)
+	errs = append(errs, validateLease(cfg.Lease)...)
+	errs = append(errs, validateNotify(cfg.Notify)...)
+
+	if _, err := compileNaming(cfg); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := parseLevel(cfg.Log.Level); err != nil {
+		add("log.level: %v", err)
+	}
+	switch cfg.Log.Format {
+	case "", "logfmt", "json":
+	default:
+		add("log.format: unknown format %q", cfg.Log.Format)
+	}
+
+	return errors.Join(errs...)
+}
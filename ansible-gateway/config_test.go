@@ -0,0 +1,95 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("ANSIBLE_GATEWAY_REDIS_ADDR", "redis:6380")
+	t.Setenv("ANSIBLE_GATEWAY_ANSIBLE_MAX_CONCURRENT", "4")
+	t.Setenv("ANSIBLE_GATEWAY_LEASE_PROBE", "true")
+	t.Setenv("ANSIBLE_GATEWAY_VERIFY_TRUSTED_PROXIES", "10.0.0.1, 192.168.0.0/16,")
+
+	cfg := Config{Redis: RedisCfg{Addr: "127.0.0.1:6379"}, Ansible: AnsibleCfg{MaxPerHostgroup: 2}}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), envPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Redis.Addr != "redis:6380" {
+		t.Errorf("redis.addr = %q", cfg.Redis.Addr)
+	}
+	// 未设置的变量不覆盖配置文件中的值
+	if cfg.Ansible.MaxConcurrent != 4 || cfg.Ansible.MaxPerHostgroup != 2 {
+		t.Errorf("ansible = %+v", cfg.Ansible)
+	}
+	if !cfg.Lease.Probe {
+		t.Error("lease.probe not set")
+	}
+	if want := []string{"10.0.0.1", "192.168.0.0/16"}; !slices.Equal(cfg.Verify.TrustedProxies, want) {
+		t.Errorf("verify.trusted_proxies = %q", cfg.Verify.TrustedProxies)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	t.Setenv("ANSIBLE_GATEWAY_ANSIBLE_MAX_CONCURRENT", "four")
+	t.Setenv("ANSIBLE_GATEWAY_LEASE_PROBE", "maybe")
+	t.Setenv("ANSIBLE_GATEWAY_AUTH_CREDENTIALS", "x")
+
+	var cfg Config
+	err := applyEnv(reflect.ValueOf(&cfg).Elem(), envPrefix)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, s := range []string{
+		`ANSIBLE_GATEWAY_ANSIBLE_MAX_CONCURRENT: invalid int "four"`,
+		`ANSIBLE_GATEWAY_LEASE_PROBE: invalid bool "maybe"`,
+		"ANSIBLE_GATEWAY_AUTH_CREDENTIALS: not supported",
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error missing %q: %v", s, err)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	good := Config{
+		Server:  ServerCfg{Addr: ":8080"},
+		Redis:   RedisCfg{Addr: "127.0.0.1:6379"},
+		Ansible: AnsibleCfg{Dir: t.TempDir(), Log: t.TempDir()},
+	}
+	if err := validateConfig(good); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+
+	bad := good
+	bad.Server.Addr = "8080"
+	bad.Ansible.Dir = filepath.Join(t.TempDir(), "missing")
+	bad.Ansible.MaxQueue = -1
+	bad.Ansible.BatchWindow = "5 seconds"
+	bad.Registry.Backend = "etcd"
+	bad.Auth.Credentials = []Credential{{Name: "goods", Token: "t", Secret: "s"}}
+	bad.Verify.Mode = "token"
+	bad.Log.Format = "xml"
+	err := validateConfig(bad)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	// 一次列出全部问题
+	for _, s := range []string{
+		`server.addr: invalid address "8080"`,
+		"ansible.dir: ",
+		"ansible.max_queue: must not be negative",
+		`ansible.batch_window: invalid duration "5 seconds"`,
+		`registry.backend: unknown backend "etcd"`,
+		"auth.credentials[0]: exactly one of token/secret is required",
+		"verify.bootstrap_secret is required in token mode",
+		`log.format: unknown format "xml"`,
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error missing %q: %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 每个 hostname 保留的历史条数，超出时丢弃最旧的
+const maxHistory = 50
+
+// 历史记录的动作
+const (
+	historyRegister   = "register"   // 首次注册（含自动分配）拿到锁
+	historyUnregister = "unregister" // 注销释放锁
+	historyReap       = "reap"       // 租约过期被回收
+	historyTakeover   = "takeover"   // 管理员强制改绑
+)
+
+// HistoryEntry：hostname 持有者的一次变更，保存在锁记录之外，注销 / 回收后仍然保留
+type HistoryEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	ID        string    `json:"id"`
+	IP        string    `json:"ip"`
+	Hostgroup string    `json:"hostgroup,omitempty"`
+	PrevID    string    `json:"prev_id,omitempty"` // takeover：之前的 ID / IP
+	PrevIP    string    `json:"prev_ip,omitempty"`
+	By        string    `json:"by"`                // 操作的凭据名，回收为 reaper
+	Outcome   string    `json:"outcome,omitempty"` // unregister：released / forced
+	Reason    string    `json:"reason,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// recordHistory：追加一条历史；写入失败只记日志，不影响锁操作本身
+func (a *App) recordHistory(ctx context.Context, hostname string, e HistoryEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, _ := json.Marshal(e)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := a.registry().AppendHistory(ctx, hostname, string(b), maxHistory); err != nil {
+		slog.Error("registry append history failed", "hostname", hostname, "action", e.Action, "err", err)
+	}
+}
+
+// hostHistory：hostname 的历史，旧的在前；格式不对的条目忽略
+func (a *App) hostHistory(ctx context.Context, hostname string) ([]HistoryEntry, error) {
+	raw, err := a.registry().History(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]HistoryEntry, 0, len(raw))
+	for _, s := range raw {
+		var e HistoryEntry
+		if json.Unmarshal([]byte(s), &e) == nil {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// GET /v1/hosts/:hostname/history：主机名的持有者变更历史，主机已注销也可以查询；只返回凭据范围内的条目
+func (a *App) getHostHistory(c *gin.Context) {
+	hostname := c.Param("hostname")
+	if !hostnameCharsRe.MatchString(hostname) {
+		c.String(http.StatusBadRequest, "invalid hostname: %s", hostname)
+		return
+	}
+	h, err := a.hostHistory(c.Request.Context(), hostname)
+	if err != nil {
+		loggerOf(c).Error("registry history failed", "hostname", hostname, "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
+	cred := credentialOf(c)
+	out := []HistoryEntry{}
+	for _, e := range h {
+		if cred.allows(e.ID, e.Hostgroup) {
+			out = append(out, e)
+		}
+	}
+	c.JSON(http.StatusOK, map[string]any{"hostname": hostname, "count": len(out), "history": out})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HostRecord：注册表中一台主机的结构化视图
+type HostRecord struct {
+	Hostname     string            `json:"hostname"`
+	ID           string            `json:"id"`
+	IP           string            `json:"ip"`
+	Addresses    map[string]string `json:"addresses,omitempty"` // 全部地址，mgmt 为管理地址
+	Hostgroup    string            `json:"hostgroup"`
+	Policy       string            `json:"policy,omitempty"`
+	Env          string            `json:"env,omitempty"`
+	Index        string            `json:"index,omitempty"`
+	RegisteredAt *time.Time        `json:"registered_at,omitempty"`
+	LastJob      string            `json:"last_job,omitempty"`
+	LastState    string            `json:"last_state,omitempty"`
+	LastRunAt    *time.Time        `json:"last_run_at,omitempty"`
+	LastResult   string            `json:"last_result,omitempty"`
+	LastLog      string            `json:"last_log,omitempty"`
+	FailedStep   string            `json:"failed_step,omitempty"` // 最近一次任务失败的步骤，可 retry
+	LastSeen     *time.Time        `json:"last_seen,omitempty"`   // 最近一次心跳
+}
+
+// 默认命名规则的 hostgroup（去掉最后的 -NNN），用于补齐没有 hostgroup 字段的旧记录
+func hostgroupOf(hostname string) string {
+	parts := strings.Split(hostname, "-")
+	return strings.Join(parts[:len(parts)-1], "-")
+}
+
+func parseTime(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// recordOf：把注册表里的字段转成 HostRecord（旧记录只有 id__ip，其余字段按规则补齐）
+func recordOf(hostname string, f map[string]string) HostRecord {
+	id, ip, _ := strings.Cut(f[fieldIDIP], "__")
+	rec := HostRecord{
+		Hostname:     hostname,
+		ID:           id,
+		IP:           ip,
+		Addresses:    parseAddrsField(ip, f[fieldAddresses]),
+		Hostgroup:    f[fieldHostgroup],
+		Policy:       f[fieldPolicy],
+		Env:          f[fieldEnv],
+		Index:        f[fieldIndex],
+		RegisteredAt: parseTime(f[fieldRegisteredAt]),
+		LastJob:      f[fieldLastJob],
+		LastState:    f[fieldLastState],
+		LastRunAt:    parseTime(f[fieldLastRunAt]),
+		LastResult:   f[fieldLastResult],
+		LastLog:      f[fieldLastLog],
+		FailedStep:   f[fieldFailedStep],
+		LastSeen:     parseTime(f[fieldLastSeen]),
+	}
+	if rec.Hostgroup == "" {
+		rec.Hostgroup = hostgroupOf(hostname)
+	}
+	return rec
+}
+
+// recordJob：任务状态变化时，把最近一次运行的信息写回主机记录
+func (a *App) recordJob(j *Job) {
+	fields := map[string]string{
+		fieldLastJob:   j.ID,
+		fieldLastState: string(j.State),
+		fieldLastLog:   j.LogPath,
+	}
+	if j.FinishedAt != nil {
+		fields[fieldLastRunAt] = j.FinishedAt.Format(time.RFC3339Nano)
+	}
+	if j.Recap != nil {
+		fields[fieldLastResult] = j.Recap.String()
+	}
+	switch j.State {
+	case JobFailed, JobInterrupted:
+		fields[fieldFailedStep] = j.Step
+	case JobSucceeded:
+		fields[fieldFailedStep] = ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.registry().Update(ctx, j.Hostname, fields); err != nil {
+		slog.Error("registry update failed", "hostname", j.Hostname, "job", j.ID, "err", err)
+	}
+}
+
+// listRecords：读出全部主机记录，按 hostname 排序
+func (a *App) listRecords(ctx context.Context) ([]HostRecord, error) {
+	names, err := a.registry().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	out := make([]HostRecord, 0, len(names))
+	for _, name := range names {
+		f, err := a.registry().Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			// List 和 Get 之间被注销了
+			continue
+		}
+		out = append(out, recordOf(name, f))
+	}
+	return out, nil
+}
+
+// GET /v1/hosts?id=&hostgroup=&ip_prefix=&registered_after=&registered_before=
+// ip_prefix 可以是字符串前缀或 CIDR，匹配主机的任一地址
+func (a *App) listHosts(c *gin.Context) {
+	id := c.Query("id")
+	hostgroup := c.Query("hostgroup")
+	ipPrefix := c.Query("ip_prefix")
+
+	var after, before *time.Time
+	for _, q := range []struct {
+		name string
+		dst  **time.Time
+	}{{"registered_after", &after}, {"registered_before", &before}} {
+		v := c.Query(q.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid %s: %s (want RFC3339)", q.name, v)
+			return
+		}
+		*q.dst = &t
+	}
+
+	recs, err := a.listRecords(c.Request.Context())
+	if err != nil {
+		loggerOf(c).Error("list hosts failed", "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
+
+	cred := credentialOf(c)
+	hosts := make([]HostRecord, 0, len(recs))
+	for _, r := range recs {
+		if !cred.allows(r.ID, r.Hostgroup) {
+			continue
+		}
+		if id != "" && r.ID != id {
+			continue
+		}
+		if hostgroup != "" && r.Hostgroup != hostgroup {
+			continue
+		}
+		if ipPrefix != "" && !matchAddrPrefix(r.Addresses, ipPrefix) {
+			continue
+		}
+		if after != nil && (r.RegisteredAt == nil || r.RegisteredAt.Before(*after)) {
+			continue
+		}
+		if before != nil && (r.RegisteredAt == nil || !r.RegisteredAt.Before(*before)) {
+			continue
+		}
+		hosts = append(hosts, r)
+	}
+
+	c.JSON(http.StatusOK, map[string]any{
+		"total": len(hosts),
+		"hosts": hosts,
+	})
+}
+
+// GET /v1/hosts/:hostname
+func (a *App) getHost(c *gin.Context) {
+	hostname := c.Param("hostname")
+	if !hostnameCharsRe.MatchString(hostname) {
+		c.String(http.StatusBadRequest, "invalid hostname: %s", hostname)
+		return
+	}
+
+	f, err := a.registry().Get(c.Request.Context(), hostname)
+	if err != nil {
+		loggerOf(c).Error("registry get failed", "hostname", hostname, "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
+	rec := recordOf(hostname, f)
+	if f == nil || !credentialOf(c).allows(rec.ID, rec.Hostgroup) {
+		c.String(http.StatusNotFound, "host not registered: %s", hostname)
+		return
+	}
+	c.JSON(http.StatusOK, rec)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hostVars：动态 inventory 中每台主机的变量
+func hostVars(r HostRecord, user string) map[string]any {
+	vars := map[string]any{
+		"ansible_host":      r.IP,
+		"gateway_id":        r.ID,
+		"gateway_hostgroup": r.Hostgroup,
+		"gateway_addresses": r.Addresses,
+	}
+	if user != "" {
+		vars["ansible_user"] = user
+	}
+	if r.RegisteredAt != nil {
+		vars["gateway_registered_at"] = r.RegisteredAt.Format(time.RFC3339)
+	}
+	if r.Env != "" {
+		vars["gateway_env"] = r.Env
+	}
+	if r.Index != "" {
+		vars["gateway_index"] = r.Index
+	}
+	if r.LastState != "" {
+		vars["gateway_last_state"] = r.LastState
+	}
+	return vars
+}
+
+// buildInventory：按 ansible 动态 inventory 的 JSON 格式输出，
+// 主机以 hostname 命名（ansible_host 指向 IP），分组沿用注册时的 hostgroup 规则
+func buildInventory(recs []HostRecord, user string) map[string]any {
+	hostvars := make(map[string]any, len(recs))
+	groups := make(map[string][]string)
+	for _, r := range recs {
+		hostvars[r.Hostname] = hostVars(r, user)
+		groups[r.Hostgroup] = append(groups[r.Hostgroup], r.Hostname)
+	}
+
+	names := make([]string, 0, len(groups))
+	for g := range groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+
+	inv := map[string]any{
+		"_meta": map[string]any{"hostvars": hostvars},
+		"all":   map[string]any{"children": names},
+	}
+	for _, g := range names {
+		inv[g] = map[string]any{"hosts": groups[g]}
+	}
+	return inv
+}
+
+// GET /v1/inventory
+func (a *App) getInventory(c *gin.Context) {
+	recs, err := a.listRecords(c.Request.Context())
+	if err != nil {
+		loggerOf(c).Error("list hosts failed", "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
+	cred := credentialOf(c)
+	allowed := recs[:0]
+	for _, r := range recs {
+		if cred.allows(r.ID, r.Hostgroup) {
+			allowed = append(allowed, r)
+		}
+	}
+	c.JSON(http.StatusOK, buildInventory(allowed, a.config().Ansible.User))
+}
+
+// runInventoryCLI：作为 ansible 的 inventory 脚本运行（--list / --host <hostname>），直接读注册表
+func runInventoryCLI(cfg Config, host string) error {
+	reg, err := newRegistry(cfg)
+	if err != nil {
+		return err
+	}
+	defer reg.Close()
+
+	app := &App{}
+	app.state.Store(&appState{cfg: cfg, reg: reg})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var out any
+	if host == "" {
+		recs, err := app.listRecords(ctx)
+		if err != nil {
+			return err
+		}
+		out = buildInventory(recs, cfg.Ansible.User)
+	} else {
+		f, err := reg.Get(ctx, host)
+		if err != nil {
+			return err
+		}
+		// 未注册的主机按约定返回空对象
+		out = map[string]any{}
+		if f != nil {
+			out = hostVars(recordOf(host, f), cfg.Ansible.User)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return fmt.Errorf("encode inventory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 任务状态
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	// 网关退出时被中断（或上次进程异常退出时仍未结束）
+	JobInterrupted JobState = "interrupted"
+)
+
+// Job：一次主机初始化任务，和发起请求的 HTTP 连接解耦，客户端断开后继续执行
+type Job struct {
+	ID         string `json:"id"`
+	HostID     string `json:"host_id"`
+	Hostname   string `json:"hostname"`
+	IP         string `json:"ip"`
+	Hostgroup  string `json:"hostgroup"`
+	Credential string `json:"credential"` // 触发本次运行的凭据
+	RequestID  string `json:"request_id,omitempty"`
+	Playbook   string `json:"playbook"`
+	// 命名规则的 playbook 目录，ansible-playbook 在此目录下运行
+	PlaybookDir string         `json:"playbook_dir,omitempty"`
+	Vars        map[string]any `json:"vars,omitempty"` // 请求携带的 extra vars / tags
+	Tags        []string       `json:"tags,omitempty"`
+	// 当前步骤（hostname / playbook），任务失败时即失败的步骤
+	Step        string       `json:"step,omitempty"`
+	StartStep   string       `json:"start_step,omitempty"`    // 重试时从哪一步开始
+	StartAtTask string       `json:"start_at_task,omitempty"` // 传给 --start-at-task
+	FailedTask  string       `json:"failed_task,omitempty"`   // playbook 中失败的 task
+	RetryOf     string       `json:"retry_of,omitempty"`      // 手动重试时的上一个任务
+	Attempt     int          `json:"attempt,omitempty"`       // 主机不可达时已自动重试的次数
+	Inventory   string       `json:"inventory"`
+	Batch       string       `json:"batch,omitempty"` // 合并运行时共享的 inventory
+	LogPath     string       `json:"log_path"`
+	State       JobState     `json:"state"`
+	CreatedAt   time.Time    `json:"created_at"`
+	StartedAt   *time.Time   `json:"started_at,omitempty"`
+	FinishedAt  *time.Time   `json:"finished_at,omitempty"`
+	ExitCode    *int         `json:"exit_code,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Recap       *HostRecap   `json:"recap,omitempty"`
+	Tasks       []TaskResult `json:"tasks,omitempty"`
+
+	mu   sync.Mutex
+	out  *os.File
+	done chan struct{}
+	log  *slog.Logger // 带 request_id / host_id / hostname / ip / hostgroup / job
+}
+
+var jobIDRe = regexp.MustCompile(`^\d{14}-[0-9a-f]{8}$`)
+
+func newJobID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(b)
+}
+
+// Write：任务日志只有一个写入点，stdout/stderr 两个 goroutine 并发写时加锁
+func (j *Job) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.out == nil {
+		return len(p), nil
+	}
+	return j.out.Write(p)
+}
+
+// logf：双写到全局日志 + 任务日志（客户端通过任务日志回放）
+func (j *Job) logf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	logLine(j.log, msg)
+	fmt.Fprintf(j, "%s %s\n", time.Now().Format("2006/01/02 15:04:05.000000"), msg)
+}
+
+// jobLogger：任务相关的每一行日志都带上这些字段，便于在日志系统中串起一次注册
+func jobLogger(j *Job) *slog.Logger {
+	return slog.With("request_id", j.RequestID, "host_id", j.HostID, "hostname", j.Hostname,
+		"ip", j.IP, "hostgroup", j.Hostgroup, "job", j.ID)
+}
+
+func (j *Job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// snapshot：加锁拷贝一份，用于序列化
+func (j *Job) snapshot() Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return Job{
+		ID:          j.ID,
+		HostID:      j.HostID,
+		Hostname:    j.Hostname,
+		IP:          j.IP,
+		Hostgroup:   j.Hostgroup,
+		Credential:  j.Credential,
+		RequestID:   j.RequestID,
+		Playbook:    j.Playbook,
+		PlaybookDir: j.PlaybookDir,
+		Vars:        j.Vars,
+		Tags:        j.Tags,
+		Step:        j.Step,
+		StartStep:   j.StartStep,
+		StartAtTask: j.StartAtTask,
+		FailedTask:  j.FailedTask,
+		RetryOf:     j.RetryOf,
+		Attempt:     j.Attempt,
+		Inventory:   j.Inventory,
+		Batch:       j.Batch,
+		LogPath:     j.LogPath,
+		State:       j.State,
+		CreatedAt:   j.CreatedAt,
+		StartedAt:   j.StartedAt,
+		FinishedAt:  j.FinishedAt,
+		ExitCode:    j.ExitCode,
+		Error:       j.Error,
+		Recap:       j.Recap,
+		Tasks:       j.Tasks,
+	}
+}
+
+// jobStore：运行中的任务放内存，所有任务的状态落盘到 <ansible.log>/jobs/<id>.json
+type jobStore struct {
+	dir string
+	// onState：任务创建、开始、结束时回调（用于回写主机记录）
+	onState func(*Job)
+
+	mu     sync.Mutex
+	active map[string]*Job
+	wg     sync.WaitGroup // 未结束的任务数，退出时等待
+}
+
+func newJobStore(dir string) *jobStore {
+	return &jobStore{dir: dir, active: make(map[string]*Job)}
+}
+
+// errJobActive：同一 hostname 已有未结束的任务，不再创建新任务
+var errJobActive = errors.New("job already active")
+
+// activeFor：hostname 未结束的任务，没有返回 nil
+func (s *jobStore) activeFor(hostname string) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.activeForLocked(hostname)
+}
+
+func (s *jobStore) activeForLocked(hostname string) *Job {
+	for _, j := range s.active {
+		if j.Hostname == hostname {
+			return j
+		}
+	}
+	return nil
+}
+
+// create：创建任务并打开任务日志文件（沿用原来 tee 的命名：<id>__<hostname>__<ip>__<时间>.log）；
+// 同一 hostname 已有未结束的任务时返回 errJobActive
+func (s *jobStore) create(req HostReq, name HostName, playbook, invPath, credential, requestID string) (*Job, error) {
+	if j := s.activeFor(req.Hostname); j != nil {
+		return nil, fmt.Errorf("%w: %s", errJobActive, j.ID)
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir jobs dir: %w", err)
+	}
+
+	logPath := filepath.Join(filepath.Dir(invPath), fmt.Sprintf("%s__%s__%s__%s.log",
+		req.ID, req.Hostname, req.IP, time.Now().Format("2006-01-02_15:04:05.000000")))
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open job log: %w", err)
+	}
+
+	j := &Job{
+		ID:          newJobID(),
+		HostID:      req.ID,
+		Hostname:    req.Hostname,
+		IP:          req.IP,
+		Hostgroup:   name.Hostgroup,
+		Playbook:    playbook,
+		PlaybookDir: name.PlaybookDir,
+		Vars:        req.Vars,
+		Tags:        req.Tags,
+		Inventory:   invPath,
+		LogPath:     logPath,
+		Credential:  credential,
+		RequestID:   requestID,
+		State:       JobQueued,
+		CreatedAt:   time.Now(),
+		out:         f,
+		done:        make(chan struct{}),
+	}
+	j.log = jobLogger(j)
+
+	s.mu.Lock()
+	if cur := s.activeForLocked(req.Hostname); cur != nil {
+		s.mu.Unlock()
+		_ = f.Close()
+		_ = os.Remove(logPath)
+		return nil, fmt.Errorf("%w: %s", errJobActive, cur.ID)
+	}
+	s.active[j.ID] = j
+	s.mu.Unlock()
+
+	if err := s.save(j); err != nil {
+		_ = f.Close()
+		s.mu.Lock()
+		delete(s.active, j.ID)
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.wg.Add(1)
+	s.notify(j)
+	return j, nil
+}
+
+// start / finish：状态迁移，每次迁移都落盘（自动重试时任务已在运行，start 不重复记录）
+func (s *jobStore) start(j *Job) {
+	now := time.Now()
+	j.mu.Lock()
+	if j.State == JobRunning {
+		j.mu.Unlock()
+		return
+	}
+	j.State = JobRunning
+	j.StartedAt = &now
+	j.mu.Unlock()
+	if err := s.save(j); err != nil {
+		j.log.Error("save job failed", "err", err)
+	}
+	s.notify(j)
+}
+
+func (s *jobStore) finish(j *Job, runErr error) {
+	now := time.Now()
+	j.mu.Lock()
+	j.FinishedAt = &now
+	code := 0
+	if runErr != nil {
+		j.State = JobFailed
+		if errors.Is(runErr, errShutdown) {
+			j.State = JobInterrupted
+		}
+		j.Error = runErr.Error()
+		code = -1
+		var ee *exec.ExitError
+		if errors.As(runErr, &ee) {
+			code = ee.ExitCode()
+		}
+	} else {
+		j.State = JobSucceeded
+	}
+	j.ExitCode = &code
+	if j.out != nil {
+		_ = j.out.Close()
+		j.out = nil
+	}
+	state := j.State
+	j.mu.Unlock()
+	metricJobs.WithLabelValues(j.Hostgroup, string(state)).Inc()
+
+	if err := s.save(j); err != nil {
+		j.log.Error("save job failed", "err", err)
+	}
+	s.notify(j)
+
+	s.mu.Lock()
+	delete(s.active, j.ID)
+	s.mu.Unlock()
+	close(j.done)
+	s.wg.Done()
+}
+
+// hold：任务之外的后台操作（注销清理）也计入退出等待，结束时调用返回的函数
+func (s *jobStore) hold() func() {
+	s.wg.Add(1)
+	return s.wg.Done
+}
+
+// count：未结束的任务数
+func (s *jobStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.active)
+}
+
+// wait：等待所有任务结束，ctx 到期返回 ctx.Err()
+func (s *jobStore) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *jobStore) notify(j *Job) {
+	if s.onState != nil {
+		snap := j.snapshot()
+		s.onState(&snap)
+	}
+}
+
+// update：修改任务字段并落盘
+func (s *jobStore) update(j *Job, fn func(*Job)) {
+	j.mu.Lock()
+	fn(j)
+	j.mu.Unlock()
+	if err := s.save(j); err != nil {
+		j.log.Error("save job failed", "err", err)
+	}
+}
+
+// save：先写临时文件再 rename，避免读到半个 JSON
+func (s *jobStore) save(j *Job) error {
+	snap := j.snapshot()
+	b, err := json.MarshalIndent(&snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(s.dir, j.ID+".json")
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("write job: %w", err)
+	}
+	return os.Rename(tmp, p)
+}
+
+// get：先查内存中运行的任务，查不到再读盘（已结束或进程重启前的任务）
+func (s *jobStore) get(id string) (*Job, error) {
+	if !jobIDRe.MatchString(id) {
+		return nil, fmt.Errorf("invalid job id: %s", id)
+	}
+
+	s.mu.Lock()
+	j, ok := s.active[id]
+	s.mu.Unlock()
+	if ok {
+		return j, nil
+	}
+
+	b, err := os.ReadFile(filepath.Join(s.dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	j = &Job{}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("parse job %s: %w", id, err)
+	}
+	// 盘上的任务不会再有写入，直接视为已结束；仍是 queued/running 说明上次进程异常退出
+	if j.State == JobQueued || j.State == JobRunning {
+		j.State = JobInterrupted
+	}
+	j.log = jobLogger(j)
+	j.done = make(chan struct{})
+	close(j.done)
+	return j, nil
+}
+
+// follow：把任务日志从头回放给客户端，任务未结束时持续跟随（类似 tail -f）
+func followJob(ctx context.Context, j *Job, w io.Writer) error {
+	f, err := os.Open(j.LogPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	flush := func() {
+		if fl, ok := w.(http.Flusher); ok {
+			fl.Flush()
+		}
+	}
+
+	for {
+		// 先判断是否结束，再读到 EOF，保证结束前写入的内容一定被读完
+		finished := j.finished()
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+		flush()
+		if finished {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errClientGone
+		case <-j.done:
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+var errClientGone = errors.New("client disconnected")
+
+// lookupJob：按 URL 中的 id 取任务，并校验凭据范围；失败时已写好响应
+func (a *App) lookupJob(c *gin.Context) (*Job, bool) {
+	j, err := a.jobs.get(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.String(http.StatusNotFound, "job not found")
+			return nil, false
+		}
+		c.String(http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	// 无权查看的任务按不存在处理
+	if !credentialOf(c).allows(j.HostID, j.Hostgroup) {
+		c.String(http.StatusNotFound, "job not found")
+		return nil, false
+	}
+	return j, true
+}
+
+// GET /v1/jobs/:id：查询任务状态
+func (a *App) getJob(c *gin.Context) {
+	j, ok := a.lookupJob(c)
+	if !ok {
+		return
+	}
+	snap := j.snapshot()
+	c.JSON(http.StatusOK, &snap)
+}
+
+// GET /v1/jobs/:id/result：结构化结果（PLAY RECAP + 每个 task 的结果）
+func (a *App) getJobResult(c *gin.Context) {
+	j, ok := a.lookupJob(c)
+	if !ok {
+		return
+	}
+	snap := j.snapshot()
+	c.JSON(http.StatusOK, map[string]any{
+		"id":       snap.ID,
+		"hostname": snap.Hostname,
+		"ip":       snap.IP,
+		"state":    snap.State,
+		"recap":    snap.Recap,
+		"summary":  summarizeTasks(snap.Tasks),
+		"tasks":    snap.Tasks,
+	})
+}
+
+// GET /v1/jobs/:id/log：重新接入任务的输出流
+func (a *App) getJobLog(c *gin.Context) {
+	j, ok := a.lookupJob(c)
+	if !ok {
+		return
+	}
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Job-ID", j.ID)
+
+	if err := followJob(c.Request.Context(), j, w); err != nil && !errors.Is(err, errClientGone) {
+		slog.Error("follow job failed", "job", j.ID, "err", err)
+	}
+}
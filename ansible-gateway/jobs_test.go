@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestJob(t *testing.T, s *jobStore, id, ip string) *Job {
+	t.Helper()
+	req := HostReq{ID: id, Hostname: "prod-web-001", IP: ip}
+	inv := filepath.Join(t.TempDir(), id+"__prod-web-001__"+ip+".txt")
+	j, err := s.create(req, HostName{Hostgroup: "prod-web"}, "prod-web.yml", inv, "goods", "rid-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestJobStoreLifecycle(t *testing.T) {
+	s := newJobStore(t.TempDir())
+	var states []JobState
+	s.onState = func(j *Job) { states = append(states, j.State) }
+
+	j := newTestJob(t, s, "biz-a", "10.0.0.1")
+	if j.State != JobQueued || s.count() != 1 || s.activeFor("prod-web-001") != j {
+		t.Fatalf("after create: state=%s count=%d", j.State, s.count())
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, j.ID+".json")); err != nil {
+		t.Fatalf("job not saved: %v", err)
+	}
+
+	// 同一 hostname 只能有一个未结束的任务
+	inv := filepath.Join(t.TempDir(), "inv.txt")
+	_, err := s.create(HostReq{ID: "biz-a", Hostname: "prod-web-001", IP: "10.0.0.1"}, HostName{}, "", inv, "", "")
+	if !errors.Is(err, errJobActive) {
+		t.Fatalf("second create: err = %v", err)
+	}
+	if logs, _ := filepath.Glob(filepath.Join(filepath.Dir(inv), "*.log")); len(logs) != 0 {
+		t.Fatalf("log of refused job left behind: %v", logs)
+	}
+
+	s.start(j)
+	s.start(j) // 重复 start 不重复记录
+	j.logf("[INFO] hello")
+	s.finish(j, nil)
+
+	if !j.finished() || s.count() != 0 || s.activeFor("prod-web-001") != nil {
+		t.Fatalf("after finish: finished=%v count=%d", j.finished(), s.count())
+	}
+	want := []JobState{JobQueued, JobRunning, JobSucceeded}
+	if len(states) != len(want) {
+		t.Fatalf("onState = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("onState = %v, want %v", states, want)
+		}
+	}
+	if err := s.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 已结束的任务从盘上读
+	got, err := s.get(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == j || got.State != JobSucceeded || got.ExitCode == nil || *got.ExitCode != 0 ||
+		got.StartedAt == nil || got.Credential != "goods" || !got.finished() {
+		t.Fatalf("loaded job = %+v", got.snapshot())
+	}
+	b, _ := os.ReadFile(j.LogPath)
+	if !strings.Contains(string(b), "[INFO] hello") {
+		t.Fatalf("job log = %q", b)
+	}
+}
+
+func TestJobStoreFinishStates(t *testing.T) {
+	tests := []struct {
+		err  error
+		want JobState
+	}{
+		{errors.New("boom"), JobFailed},
+		{errShutdown, JobInterrupted},
+	}
+	for _, tt := range tests {
+		s := newJobStore(t.TempDir())
+		j := newTestJob(t, s, "biz-a", "10.0.0.1")
+		s.finish(j, tt.err)
+		if j.State != tt.want || *j.ExitCode != -1 || j.Error != tt.err.Error() {
+			t.Errorf("finish(%v): state=%s exit=%d err=%q", tt.err, j.State, *j.ExitCode, j.Error)
+		}
+	}
+}
+
+func TestJobStoreGet(t *testing.T) {
+	s := newJobStore(t.TempDir())
+	if _, err := s.get("../../etc/passwd"); err == nil {
+		t.Fatal("invalid id accepted")
+	}
+	if _, err := s.get(newJobID()); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing job: err = %v", err)
+	}
+
+	// 运行中的任务从内存取
+	j := newTestJob(t, s, "biz-a", "10.0.0.1")
+	if got, _ := s.get(j.ID); got != j {
+		t.Fatal("active job not returned from memory")
+	}
+
+	// 上次进程退出时仍在运行的任务视为中断
+	old := &Job{ID: newJobID(), State: JobRunning}
+	if err := s.save(old); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.get(old.ID)
+	if err != nil || got.State != JobInterrupted || !got.finished() {
+		t.Fatalf("stale job: state=%v err=%v", got, err)
+	}
+}
+
+func TestFollowJob(t *testing.T) {
+	s := newJobStore(t.TempDir())
+	j := newTestJob(t, s, "biz-a", "10.0.0.1")
+	j.Write([]byte("line 1\n"))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		j.Write([]byte("line 2\n"))
+		s.finish(j, nil)
+	}()
+
+	var out bytes.Buffer
+	if err := followJob(context.Background(), j, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "line 1\nline 2\n" {
+		t.Fatalf("followed = %q", out.String())
+	}
+
+	// 客户端断开：任务继续运行
+	j2 := newTestJob(t, newJobStore(t.TempDir()), "biz-a", "10.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := followJob(ctx, j2, &out); !errors.Is(err, errClientGone) {
+		t.Fatalf("cancelled follow: err = %v", err)
+	}
+	if j2.finished() {
+		t.Fatal("job finished with the client")
+	}
+}
+
+func TestAttachJob(t *testing.T) {
+	s := newJobStore(t.TempDir())
+	j := newTestJob(t, s, "biz-a", "10.0.0.1")
+	a := &App{}
+	attach := func(id, ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/host/register", nil)
+		req := HostReq{ID: id, Hostname: "prod-web-001", IP: ip}
+		a.attachJob(context.Background(), c, req, j, func(string, ...any) {})
+		return w
+	}
+
+	// 上一个持有者的任务还在跑：不跟随
+	w := attach("biz-b", "10.0.0.2")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "job "+j.ID+" of previous owner is still queued") {
+		t.Fatalf("other owner: code=%d body=%q", w.Code, w.Body.String())
+	}
+
+	// 同一主机重试：回放并跟随到任务结束
+	j.Write([]byte("running playbook\n"))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		j.Write([]byte("done\n"))
+		s.finish(j, nil)
+	}()
+	w = attach("biz-a", "10.0.0.1")
+	if w.Code != http.StatusOK || w.Body.String() != "running playbook\ndone\n" {
+		t.Fatalf("same owner: code=%d body=%q", w.Code, w.Body.String())
+	}
+}
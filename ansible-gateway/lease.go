@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LeaseCfg：注册记录的租约。ttl 为空 / 0 时记录永不过期（原有行为）；
+// 否则主机需在 ttl 内调用 /v1/host/heartbeat 续约，超时未续约的记录由后台回收
+type LeaseCfg struct {
+	TTL          string `yaml:"ttl"`
+	ReapInterval string `yaml:"reap_interval"` // 回收扫描间隔，默认 1m
+	Probe        bool   `yaml:"probe"`         // 回收前探测 SSH 端口，可达则保留记录
+	ProbePort    int    `yaml:"probe_port"`    // 默认 22
+	ProbeTimeout string `yaml:"probe_timeout"` // 默认 3s
+	AuditLog     string `yaml:"audit_log"`     // 回收记录（JSON Lines），默认 <ansible.log>/reaped.jsonl
+}
+
+const fieldLastSeen = "last_seen"
+
+// lastActive：最近一次活动时间（心跳 / 注册 / 任务结束），旧记录可能都没有
+func lastActive(rec HostRecord) time.Time {
+	var t time.Time
+	for _, p := range []*time.Time{rec.LastSeen, rec.RegisteredAt, rec.LastRunAt} {
+		if p != nil && p.After(t) {
+			t = *p
+		}
+	}
+	return t
+}
+
+// heartbeat：POST /v1/host/heartbeat，续约主机的注册记录（ID / IP 必须和注册时一致）
+func (a *App) heartbeat(c *gin.Context) {
+	var req HostReq
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, 1<<20)).Decode(&req); err != nil {
+		c.String(http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := validate(&req); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx := c.Request.Context()
+	name, err := a.nameOf(ctx, req.ID, req.Hostname)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	lg := loggerOf(c).With("host_id", req.ID, "hostname", req.Hostname, "ip", req.IP, "hostgroup", name.Hostgroup)
+	c.Set(ctxLogger, lg)
+	if !authorize(c, req, name.Hostgroup) {
+		return
+	}
+
+	stored, err := a.registry().Owner(ctx, req.Hostname)
+	if err != nil {
+		lg.Error("registry get failed", "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
+	if stored == "" {
+		c.String(http.StatusNotFound, "host not registered: %s", req.Hostname)
+		return
+	}
+	if incoming := req.ID + "__" + req.IP; stored != incoming {
+		lg.Warn("heartbeat mismatch", "stored", stored, "incoming", incoming)
+		c.String(http.StatusPreconditionFailed, "mismatch: stored=%q incoming=%q", stored, incoming)
+		return
+	}
+
+	now := time.Now()
+	if err := a.registry().Update(ctx, req.Hostname, map[string]string{
+		fieldLastSeen: now.Format(time.RFC3339Nano),
+	}); err != nil {
+		lg.Error("registry update failed", "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
+	lg.Debug("heartbeat")
+
+	resp := map[string]any{"ok": true, "hostname": req.Hostname, "last_seen": now}
+	if ttl := mustDur(a.config().Lease.TTL, 0); ttl > 0 {
+		resp["ttl"] = ttl.String()
+		resp["expires_at"] = now.Add(ttl)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// ReapRecord：一条回收记录，追加写入 lease.audit_log
+type ReapRecord struct {
+	Time      time.Time  `json:"time"`
+	Hostname  string     `json:"hostname"`
+	ID        string     `json:"id"`
+	IP        string     `json:"ip"`
+	Hostgroup string     `json:"hostgroup"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"` // 最近一次活动
+	TTL       string     `json:"ttl"`
+	Probe     string     `json:"probe,omitempty"` // 回收前的 SSH 探测结果
+}
+
+// reaper：回收超时未续约的注册记录
+type reaper struct {
+	app *App
+	mu  sync.Mutex // 回收记录文件的追加写
+}
+
+// run：按 reap_interval 扫描，直到网关退出；间隔和 TTL 每轮重新读取配置，热加载后生效
+func (r *reaper) run(ctx context.Context) {
+	for {
+		lc := r.app.config().Lease
+		t := time.NewTimer(mustDur(lc.ReapInterval, time.Minute))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		if ttl := mustDur(lc.TTL, 0); ttl > 0 {
+			r.scan(ctx, ttl)
+		}
+	}
+}
+
+func (r *reaper) scan(ctx context.Context, ttl time.Duration) {
+	recs, err := r.app.listRecords(ctx)
+	if err != nil {
+		slog.Error("reaper: list hosts failed", "err", err)
+		return
+	}
+	now := time.Now()
+	for _, rec := range recs {
+		seen := lastActive(rec)
+		// 没有任何时间记录的旧记录无法判断，跳过；正在运行任务的主机不回收
+		if seen.IsZero() || now.Sub(seen) <= ttl {
+			continue
+		}
+		if rec.LastJob != "" {
+			if j, err := r.app.jobs.get(rec.LastJob); err == nil && !j.finished() {
+				continue
+			}
+		}
+		r.reap(ctx, rec, seen, ttl)
+	}
+}
+
+// reap：可选先探测 SSH，再确认记录未被续约或重新注册后删除，并写回收记录
+func (r *reaper) reap(ctx context.Context, rec HostRecord, seen time.Time, ttl time.Duration) {
+	lg := slog.With("hostname", rec.Hostname, "host_id", rec.ID, "ip", rec.IP, "hostgroup", rec.Hostgroup)
+	lc := r.app.config().Lease
+
+	var probe string
+	if lc.Probe {
+		port := lc.ProbePort
+		if port == 0 {
+			port = 22
+		}
+		addr := net.JoinHostPort(rec.IP, strconv.Itoa(port))
+		conn, err := net.DialTimeout("tcp", addr, mustDur(lc.ProbeTimeout, 3*time.Second))
+		if err == nil {
+			_ = conn.Close()
+			metricReaped.WithLabelValues("reachable").Inc()
+			lg.Info("reaper: lease expired but ssh is reachable, keep", "last_seen", seen, "addr", addr)
+			return
+		}
+		probe = err.Error()
+	}
+
+	// 探测期间可能收到心跳或被注销后重新注册
+	f, err := r.app.registry().Get(ctx, rec.Hostname)
+	if err != nil {
+		metricReaped.WithLabelValues("registry_error").Inc()
+		lg.Error("reaper: registry get failed", "err", err)
+		return
+	}
+	if f == nil {
+		return
+	}
+	cur := recordOf(rec.Hostname, f)
+	if cur.ID != rec.ID || cur.IP != rec.IP || !lastActive(cur).Equal(seen) {
+		return
+	}
+	// 只有持有者和各个活动时间都没变时才删除，和 Get 之后到达的心跳 / 任务结束不会交错
+	ok, err := r.app.registry().ReleaseIf(ctx, rec.Hostname, map[string]string{
+		fieldIDIP:         f[fieldIDIP],
+		fieldLastSeen:     f[fieldLastSeen],
+		fieldRegisteredAt: f[fieldRegisteredAt],
+		fieldLastRunAt:    f[fieldLastRunAt],
+	})
+	if err != nil {
+		metricReaped.WithLabelValues("registry_error").Inc()
+		lg.Error("reaper: registry release failed", "err", err)
+		return
+	}
+	if !ok {
+		lg.Info("reaper: record renewed while reaping, keep")
+		return
+	}
+	metricReaped.WithLabelValues("reaped").Inc()
+	r.app.recordHistory(ctx, rec.Hostname, HistoryEntry{
+		Action: historyReap, ID: rec.ID, IP: rec.IP, Hostgroup: rec.Hostgroup,
+		By: "reaper", Reason: fmt.Sprintf("no activity since %s (ttl %s)", seen.Format(time.RFC3339), ttl),
+	})
+	lg.Info("audit", "credential", "reaper", "action", "reap", "last_seen", seen, "ttl", ttl.String(), "probe", probe)
+	r.app.notifier.send(Event{
+		Event: eventUnregister, Hostname: rec.Hostname, ID: rec.ID, IP: rec.IP, Hostgroup: rec.Hostgroup,
+		Outcome: "reaped", Credential: "reaper",
+	})
+
+	r.record(ReapRecord{
+		Time:      time.Now(),
+		Hostname:  rec.Hostname,
+		ID:        rec.ID,
+		IP:        rec.IP,
+		Hostgroup: rec.Hostgroup,
+		LastSeen:  &seen,
+		TTL:       ttl.String(),
+		Probe:     probe,
+	})
+}
+
+func (r *reaper) auditPath() string {
+	if p := r.app.config().Lease.AuditLog; p != "" {
+		return p
+	}
+	return filepath.Join(r.app.logDir, "reaped.jsonl")
+}
+
+func (r *reaper) record(rec ReapRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.auditPath()
+	b, _ := json.Marshal(rec)
+	err := os.MkdirAll(filepath.Dir(p), 0o755)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+			_, err = f.Write(append(b, '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		slog.Error("reaper: write audit record failed", "path", p, "err", err)
+	}
+}
+
+// GET /v1/admin/reaped?limit=：最近的回收记录（新的在前）
+func (a *App) listReaped(c *gin.Context) {
+	limit := 100
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			c.String(http.StatusBadRequest, "invalid limit: %s", s)
+			return
+		}
+		limit = n
+	}
+
+	b, err := os.ReadFile(a.reaper.auditPath())
+	if err != nil && !os.IsNotExist(err) {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := []ReapRecord{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var rec ReapRecord
+		if err := dec.Decode(&rec); err != nil {
+			break
+		}
+		out = append(out, rec)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	c.JSON(http.StatusOK, map[string]any{"count": len(out), "reaped": out})
+}
+
+// validateLease：租约相关配置
+func validateLease(lc LeaseCfg) []error {
+	var errs []error
+	if lc.ProbePort < 0 || lc.ProbePort > 65535 {
+		errs = append(errs, fmt.Errorf("lease.probe_port: invalid port %d", lc.ProbePort))
+	}
+	if v, err := time.ParseDuration(lc.ReapInterval); lc.ReapInterval != "" && err == nil && v == 0 {
+		errs = append(errs, fmt.Errorf("lease.reap_interval: must be positive"))
+	}
+	return errs
+}
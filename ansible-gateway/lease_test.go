@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReaperScan(t *testing.T) {
+	a, _ := newTestApp(t, nil)
+	a.reaper = &reaper{app: a}
+	ctx := context.Background()
+	old := time.Now().Add(-2 * time.Hour).Format(time.RFC3339Nano)
+	hosts := []struct {
+		hostname string
+		fields   map[string]string
+		reaped   bool
+	}{
+		{"prod-web-001", map[string]string{fieldLastSeen: old}, true},
+		{"prod-web-002", map[string]string{fieldLastSeen: time.Now().Format(time.RFC3339Nano)}, false},
+		{"prod-web-003", map[string]string{fieldRegisteredAt: old, fieldLastSeen: time.Now().Format(time.RFC3339Nano)}, false},
+		{"prod-web-004", nil, false},                                   // 没有时间记录的旧记录
+		{"prod-web-005", map[string]string{fieldLastSeen: old}, false}, // 任务运行中
+	}
+	for i, h := range hosts {
+		a.registry().Lock(ctx, h.hostname, fmt.Sprintf("biz-a__10.0.0.%d", i+1))
+		if h.fields != nil {
+			a.registry().Update(ctx, h.hostname, h.fields)
+		}
+	}
+	j, err := a.jobs.create(HostReq{ID: "biz-a", Hostname: "prod-web-005", IP: "10.0.0.5"},
+		HostName{Hostgroup: "prod-web"}, "prod-web.yml", filepath.Join(t.TempDir(), "inv.txt"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.registry().Update(ctx, "prod-web-005", map[string]string{fieldLastJob: j.ID})
+
+	a.reaper.scan(ctx, time.Hour)
+	for _, h := range hosts {
+		owner, _ := a.registry().Owner(ctx, h.hostname)
+		if (owner == "") != h.reaped {
+			t.Errorf("%s: owner=%q, want reaped=%v", h.hostname, owner, h.reaped)
+		}
+	}
+
+	// 回收记录写在启动时的日志目录下
+	b, err := os.ReadFile(filepath.Join(a.logDir, "reaped.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec ReapRecord
+	if err := json.Unmarshal(b, &rec); err != nil || rec.Hostname != "prod-web-001" || rec.IP != "10.0.0.1" || rec.TTL != "1h0m0s" {
+		t.Fatalf("audit record = %s (err %v)", b, err)
+	}
+}
+
+func TestReaperKeepsRenewed(t *testing.T) {
+	a, _ := newTestApp(t, nil)
+	a.reaper = &reaper{app: a}
+	ctx := context.Background()
+	a.registry().Lock(ctx, "prod-web-001", "biz-a__10.0.0.1")
+	a.registry().Update(ctx, "prod-web-001", map[string]string{fieldLastSeen: time.Now().Add(-2 * time.Hour).Format(time.RFC3339Nano)})
+	recs, _ := a.listRecords(ctx)
+
+	// 扫描之后、删除之前收到心跳：保留记录
+	a.registry().Update(ctx, "prod-web-001", map[string]string{fieldLastSeen: time.Now().Format(time.RFC3339Nano)})
+	a.reaper.reap(ctx, recs[0], lastActive(recs[0]), time.Hour)
+	if owner, _ := a.registry().Owner(ctx, "prod-web-001"); owner != "biz-a__10.0.0.1" {
+		t.Fatalf("renewed record reaped, owner = %q", owner)
+	}
+
+	// 被注销后重新注册到另一个 IP：同样保留
+	a.registry().Release(ctx, "prod-web-001")
+	a.registry().Lock(ctx, "prod-web-001", "biz-a__10.0.0.9")
+	a.reaper.reap(ctx, recs[0], lastActive(recs[0]), time.Hour)
+	if owner, _ := a.registry().Owner(ctx, "prod-web-001"); owner != "biz-a__10.0.0.9" {
+		t.Fatalf("re-registered record reaped, owner = %q", owner)
+	}
+	if _, err := os.Stat(a.reaper.auditPath()); !os.IsNotExist(err) {
+		t.Fatalf("audit record written for kept host: %v", err)
+	}
+}
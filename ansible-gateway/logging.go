@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 日志格式与级别
+type LogCfg struct {
+	Format string `yaml:"format"` // logfmt（默认）/ json
+	Level  string `yaml:"level"`  // debug / info（默认）/ warn / error
+}
+
+// logWriter：日志输出目标，SIGUSR1 重开日志文件时替换底层文件，handler 不用重建
+type logWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+func (lw *logWriter) set(w io.Writer) {
+	lw.mu.Lock()
+	lw.w = w
+	lw.mu.Unlock()
+}
+
+var logOut = &logWriter{w: os.Stderr}
+
+func parseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return l, fmt.Errorf("unknown level %q", s)
+	}
+	return l, nil
+}
+
+// configureLogger：按配置替换全局 logger（启动和热加载时调用）
+func configureLogger(cfg LogCfg) error {
+	level, err := parseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch cfg.Format {
+	case "", "logfmt":
+		h = slog.NewTextHandler(logOut, opts)
+	case "json":
+		h = slog.NewJSONHandler(logOut, opts)
+	default:
+		return fmt.Errorf("unknown format %q", cfg.Format)
+	}
+	// 同时接管标准库 log（依赖库里的 log.Printf 也输出为结构化日志）
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal：启动阶段出错，记录后退出
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// splitLevel：写给客户端的流里保留 "[INFO] " 这类前缀，写日志时拆成级别 + 正文
+func splitLevel(msg string) (slog.Level, string) {
+	for _, p := range []struct {
+		prefix string
+		level  slog.Level
+	}{
+		{"[INFO] ", slog.LevelInfo},
+		{"[WARN] ", slog.LevelWarn},
+		{"[ERROR] ", slog.LevelError},
+	} {
+		if rest, ok := strings.CutPrefix(msg, p.prefix); ok {
+			return p.level, rest
+		}
+	}
+	return slog.LevelInfo, msg
+}
+
+// logLine：按前缀级别写一行结构化日志
+func logLine(l *slog.Logger, msg string) {
+	level, rest := splitLevel(msg)
+	l.Log(context.Background(), level, rest)
+}
+
+const (
+	headerRequestID = "X-Request-ID"
+	ctxLogger       = "logger"
+)
+
+// 调用方传入的 X-Request-ID 只接受常见字符，避免日志注入
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogger：为每个请求分配 request ID（沿用合法的 X-Request-ID），写回响应头，
+// 请求结束后输出一行访问日志（替代 gin 默认的 logger）
+func requestLogger(c *gin.Context) {
+	id := c.GetHeader(headerRequestID)
+	if !requestIDRe.MatchString(id) {
+		id = newRequestID()
+	}
+	c.Header(headerRequestID, id)
+	l := slog.Default().With("request_id", id)
+	c.Set(ctxLogger, l)
+
+	start := time.Now()
+	c.Next()
+
+	l.Info("http request",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"latency", time.Since(start).String(),
+		"client", c.ClientIP(),
+	)
+}
+
+// loggerOf：当前请求的 logger，带 request_id
+func loggerOf(c *gin.Context) *slog.Logger {
+	if v, ok := c.Get(ctxLogger); ok {
+		return v.(*slog.Logger)
+	}
+	return slog.Default()
+}
+
+// requestIDOf：当前请求的 request ID
+func requestIDOf(c *gin.Context) string {
+	return c.Writer.Header().Get(headerRequestID)
+}
+
+// 读到配置之前先用默认格式（logfmt / info），启动阶段的错误也是结构化的
+func init() {
+	_ = configureLogger(LogCfg{})
+}
@@ -8,64 +8,118 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	redis "github.com/redis/go-redis/v9"
-	yaml "gopkg.in/yaml.v3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type ServerCfg struct {
-	Addr         string
-	ReadTimeout  string
-	WriteTimeout string
-	IdleTimeout  string
+	Addr         string `yaml:"addr"`
+	ReadTimeout  string `yaml:"read_timeout"`
+	WriteTimeout string `yaml:"write_timeout"`
+	IdleTimeout  string `yaml:"idle_timeout"`
+	// 退出时等待运行中任务的最长时间，超时后中断剩余任务
+	ShutdownTimeout string `yaml:"shutdown_timeout"`
 }
 
 type RedisCfg struct {
-	Addr     string
-	Password string
-	DB       int
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	// 从文件读取密码（如 /run/secrets/redis），与 password 二选一
+	PasswordFile string `yaml:"password_file"`
+	DB           int    `yaml:"db"`
 }
 
 type AnsibleCfg struct {
-	Dir  string
-	Log  string
-	User string
+	Dir  string `yaml:"dir"`
+	Log  string `yaml:"log"`
+	User string `yaml:"user"`
+
+	// 并发控制：0 表示不限制
+	MaxConcurrent   int    `yaml:"max_concurrent"`    // 全局同时运行的任务数
+	MaxPerHostgroup int    `yaml:"max_per_hostgroup"` // 每个 hostgroup 同时运行的任务数
+	MaxQueue        int    `yaml:"max_queue"`         // 排队任务上限，超出返回 503
+	RetryAfter      string `yaml:"retry_after"`       // 队列满时提示客户端的重试间隔
+
+	// 合并运行：同一 hostgroup 在时间窗内的注册合并成一次 ansible-playbook，0 表示不合并
+	BatchWindow   string `yaml:"batch_window"`
+	BatchMaxHosts int    `yaml:"batch_max_hosts"` // 单批主机数上限，达到后立即运行，0 表示不限
+
+	// 主机不可达（刚开机的虚拟机 sshd 未就绪等）时自动重试的次数，0 表示不重试；
+	// 重试间隔从 retry_backoff（默认 30s）开始每次翻倍
+	RetryUnreachable int    `yaml:"retry_unreachable"`
+	RetryBackoff     string `yaml:"retry_backoff"`
+
+	// playbook 的 stdout 回调，默认 ansible.posix.jsonl（需安装 ansible.posix collection）；
+	// 设为 "default" 则使用 ansible 默认输出，只从 PLAY RECAP 解析结果
+	StdoutCallback string `yaml:"stdout_callback"`
+
+	// 注册请求可以携带的 extra vars / tags（按 hostgroup 配置允许列表），见 vars.go
+	RequestVars []RequestVarsRule `yaml:"request_vars"`
 }
 
-type Config struct {
-	Server  ServerCfg
-	Redis   RedisCfg
-	Ansible AnsibleCfg
+// 主机名锁后端：redis（默认）/ file（本地 JSON 文件）/ memory（仅内存，重启丢失）
+type RegistryCfg struct {
+	Backend string `yaml:"backend"`
+	Path    string `yaml:"path"` // file 后端的数据文件
 }
 
-// 请求与校验
-var (
-	idRe       = regexp.MustCompile(`^[a-zA-Z0-9]+-[a-zA-Z0-9]+(?:-[a-zA-Z0-9]+)*$`)
-	hostnameRe = regexp.MustCompile(`^[a-zA-Z0-9]+-[a-zA-Z0-9]+(?:-[a-zA-Z0-9]+)*-\d{3}$`)
-	ipRe       = regexp.MustCompile(`^(?:25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(?:25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(?:25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(?:25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)$`)
-)
+type Config struct {
+	Server   ServerCfg   `yaml:"server"`
+	Redis    RedisCfg    `yaml:"redis"`
+	Registry RegistryCfg `yaml:"registry"`
+	Ansible  AnsibleCfg  `yaml:"ansible"`
+	Auth     AuthCfg     `yaml:"auth"`
+	Verify   VerifyCfg   `yaml:"verify"`
+	Log      LogCfg      `yaml:"log"`
+	Naming   NamingCfg   `yaml:"naming"`
+	Lease    LeaseCfg    `yaml:"lease"`
+	Notify   NotifyCfg   `yaml:"notify"`
+}
 
+// 请求（ID / hostname 的格式由命名规则决定，见 naming.go；地址校验见 addr.go）
 type HostReq struct {
-	ID       string `json:"ID"`
-	Hostname string `json:"Hostname"`
-	IP       string `json:"IP"`
+	ID        string         `json:"ID"`
+	Hostname  string         `json:"Hostname"`
+	IP        string         `json:"IP"`                  // 管理地址（IPv4 / IPv6），ansible 用它连接主机
+	Addresses []HostAddr     `json:"Addresses,omitempty"` // 附加地址，如 {"Name":"service","IP":"fd00::5"}
+	Vars      map[string]any `json:"Vars,omitempty"`      // 传给 ansible-playbook 的 extra vars，需在 ansible.request_vars 中允许
+	Tags      []string       `json:"Tags,omitempty"`      // 传给 ansible-playbook 的 --tags
+	Token     string         `json:"Token,omitempty"`     // verify.mode=token 时的 bootstrap token
 }
 
 type App struct {
-	cfg Config
-	rdb *redis.Client
+	cfgPath  string
+	state    atomic.Pointer[appState] // 配置 + 注册表，热加载时整体替换
+	reloadMu sync.Mutex
+
+	// ansible.log：inventory、任务日志、清理日志等都写在这里。启动时确定，
+	// 和 jobStore 的目录保持一致，热加载修改 ansible.log 需要重启生效
+	logDir   string
+	jobs     *jobStore
+	pool     *pool
+	batcher  *batcher
+	reaper   *reaper
+	notifier *notifier
+	allocMu  sync.Mutex // 自动分配 hostname 时串行化
+	teardown sync.Map   // 正在执行清理的 hostname
+
+	// 任务的根 context：退出超时后取消，正在运行的 ansible 会被中断
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	draining atomic.Bool
 }
 
 // 全局日志文件状态（用于 SIGUSR1 轮转）
@@ -79,17 +133,43 @@ func main() {
 	cfgPath := flag.String("config", "./config.yaml", "path to config file")
 	logPath := flag.String("logfile", "", "path to log file (empty=stderr)")
 	pidPath := flag.String("pidfile", "", "path to pid file")
+	checkCfg := flag.Bool("check-config", false, "validate config file, print all errors and exit (non-zero if invalid)")
+	// ansible 动态 inventory 脚本协议：--list / --host <hostname>
+	invList := flag.Bool("list", false, "print ansible dynamic inventory of registered hosts and exit")
+	invHost := flag.String("host", "", "print inventory variables of one registered host and exit")
 	flag.Parse()
 
+	// 只校验配置：给部署流水线 / systemd ExecStartPre 用
+	if *checkCfg {
+		if err := checkConfig(*cfgPath); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: invalid config:\n%v\n", *cfgPath, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: config ok\n", *cfgPath)
+		return
+	}
+
+	// inventory 模式：只读注册表输出 JSON，不写 pidfile、不启动服务
+	if *invList || *invHost != "" {
+		cfg, err := loadConfig(*cfgPath)
+		if err != nil {
+			fatal("load config failed", "err", err)
+		}
+		if err := runInventoryCLI(cfg, *invHost); err != nil {
+			fatal("inventory failed", "err", err)
+		}
+		return
+	}
+
 	// 日志初始化：如果指定了 logfile，就把 log 输出导向文件
 	if err := setupLog(*logPath); err != nil {
-		log.Fatalf("setup log: %v", err)
+		fatal("setup log failed", "err", err)
 	}
 
 	// 写 pidfile（nginx 同款风格）
 	if *pidPath != "" {
 		if err := os.WriteFile(*pidPath, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
-			log.Fatalf("write pidfile: %v", err)
+			fatal("write pidfile failed", "err", err)
 		}
 	}
 
@@ -100,32 +180,97 @@ func main() {
 
 	cfg, err := loadConfig(*cfgPath)
 	if err != nil {
-		log.Fatalf("load config: %v", err)
+		fatal("load config failed", "err", err)
+	}
+	if err := validateConfig(cfg); err != nil {
+		fatal("invalid config", "err", err)
+	}
+	if err := checkStdoutCallback(cfg.Ansible.StdoutCallback); err != nil {
+		fatal("invalid config", "err", err)
+	}
+	if err := configureLogger(cfg.Log); err != nil {
+		fatal("configure logger failed", "err", err)
 	}
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     cfg.Redis.Addr,
-		Password: cfg.Redis.Password,
-		DB:       cfg.Redis.DB,
-	})
+	naming, err := compileNaming(cfg)
+	if err != nil {
+		fatal("invalid naming policies", "err", err)
+	}
 
-	app := &App{cfg: cfg, rdb: rdb}
+	reg, err := newRegistry(cfg)
+	if err != nil {
+		fatal("open registry failed", "err", err)
+	}
+
+	app := &App{
+		cfgPath: *cfgPath,
+		logDir:  cfg.Ansible.Log,
+		jobs:    newJobStore(filepath.Join(cfg.Ansible.Log, "jobs")),
+		pool:    newPool(cfg.Ansible),
+	}
+	app.state.Store(&appState{cfg: cfg, reg: reg, naming: naming})
+	registerPoolMetrics(app.pool)
+	app.ctx, app.cancel = context.WithCancelCause(context.Background())
+	app.batcher = newBatcher(cfg.Ansible, app.submitBatch)
+	app.jobs.onState = func(j *Job) {
+		app.recordJob(j)
+		app.notifyJob(j)
+	}
+	app.reaper = &reaper{app: app}
+	app.notifier = newNotifier(app)
 
 	// gin 初始化
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
-	r.Use(gin.Logger(), gin.Recovery())
+	r.Use(requestLogger, gin.RecoveryWithWriter(logOut))
 
 	// 健康检查
 	r.GET("/health", func(c *gin.Context) {
 		c.String(http.StatusOK, "ok")
 	})
 
+	// Prometheus 指标
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	// v1 API：配置了 auth.credentials 时需要认证
+	v1 := r.Group("/v1", app.requireAuth)
+
 	// v1 host API
-	v1Host := r.Group("/v1/host")
+	v1Host := v1.Group("/host")
 	{
 		v1Host.POST("/register", app.registerHost)
 		v1Host.POST("/unregister", app.unregisterHost)
+		v1Host.POST("/plan", app.planHost)
+		v1Host.POST("/heartbeat", app.heartbeat)
+		v1Host.POST("/allocate", app.allocateHost)
+		v1Host.POST("/:hostname/retry", app.retryHost)
+	}
+
+	// v1 hosts API：查询注册表
+	v1Hosts := v1.Group("/hosts")
+	{
+		v1Hosts.GET("", app.listHosts)
+		v1Hosts.GET("/:hostname", app.getHost)
+		v1Hosts.GET("/:hostname/history", app.getHostHistory)
+	}
+
+	// ansible 动态 inventory
+	v1.GET("/inventory", app.getInventory)
+
+	// v1 admin API：需要 admin 凭据，未启用认证时拒绝
+	v1Admin := v1.Group("/admin", app.requireAdmin)
+	{
+		v1Admin.POST("/reload", app.reloadConfig)
+		v1Admin.GET("/reaped", app.listReaped)
+		v1Admin.POST("/takeover", app.takeover)
+	}
+
+	// v1 job API：查询任务状态、重新接入输出流
+	v1Jobs := v1.Group("/jobs")
+	{
+		v1Jobs.GET("/:id", app.getJob)
+		v1Jobs.GET("/:id/log", app.getJobLog)
+		v1Jobs.GET("/:id/result", app.getJobResult)
 	}
 
 	server := &http.Server{
@@ -136,12 +281,35 @@ func main() {
 		IdleTimeout:  mustDur(cfg.Server.IdleTimeout, 120*time.Second),
 	}
 
-	log.Printf("[INFO] ansible-gateway listening on %s", cfg.Server.Addr)
-
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatalf("[ERR ] server.ListenAndServe: %v", err)
+	if len(cfg.Auth.Credentials) == 0 {
+		slog.Warn("auth.credentials is empty, /v1 API is unauthenticated")
 	}
+	slog.Info("ansible-gateway listening", "addr", cfg.Server.Addr)
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("server.ListenAndServe failed", "err", err)
+		}
+	}()
 
+	// 监听 SIGHUP：重新加载配置
+	go app.handleReload()
+
+	// 回收超时未续约的注册记录（lease.ttl 为空时只空转）
+	go app.reaper.run(app.ctx)
+
+	// 等待 SIGTERM / SIGINT，优雅退出
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	slog.Info("received signal", "signal", sig.String())
+	app.shutdown(server)
+
+	if *pidPath != "" {
+		if err := os.Remove(*pidPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("remove pidfile failed", "err", err)
+		}
+	}
 }
 
 // 初始化 / 重新打开日志文件
@@ -150,7 +318,7 @@ func setupLog(path string) error {
 	if path == "" {
 		logFilePath = ""
 		logFile = nil
-		log.SetOutput(os.Stderr)
+		logOut.set(os.Stderr)
 		return nil
 	}
 
@@ -168,14 +336,14 @@ func setupLog(path string) error {
 		return fmt.Errorf("open log file: %w", err)
 	}
 
-	// 关闭旧文件（如果有）
+	// 先切到新文件，再关闭旧文件（如果有），避免并发写入已关闭的文件
+	logOut.set(f)
 	if logFile != nil {
 		_ = logFile.Close()
 	}
 
 	logFile = f
 	logFilePath = path
-	log.SetOutput(f)
 	return nil
 }
 
@@ -191,43 +359,17 @@ func handleLogReopen() {
 			// 这里不能用 log.Printf（可能已经坏了），直接写 stderr
 			fmt.Fprintf(os.Stderr, "reopen log file on SIGUSR1 failed: %v\n", err)
 		} else {
-			log.Printf("log file reopened on SIGUSR1")
+			slog.Info("log file reopened on SIGUSR1")
 		}
 	}
 }
 
-// 配置加载
-func loadConfig(path string) (Config, error) {
-	// 1. 读文件（只负责把 bytes 读出来）
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return Config{}, err
-	}
-
-	// 2. YAML 解析（负责“看得懂”缩进、冒号、列表等语法）
-	var cfg Config
-	if err := yaml.Unmarshal(b, &cfg); err != nil {
-		return Config{}, fmt.Errorf("parse config yaml: %w", err)
-	}
-
-	return cfg, nil
-}
-
-// 校验请求体
-func validate(req HostReq) error {
+// 校验请求体，地址统一成规范写法
+func validate(req *HostReq) error {
 	if req.ID == "" || req.Hostname == "" || req.IP == "" {
 		return errors.New("missing id/hostname/ip")
 	}
-	if !idRe.MatchString(req.ID) {
-		return fmt.Errorf("invalid id: %s", req.ID)
-	}
-	if !hostnameRe.MatchString(req.Hostname) {
-		return fmt.Errorf("invalid hostname: %s", req.Hostname)
-	}
-	if !ipRe.MatchString(req.IP) {
-		return fmt.Errorf("invalid ip: %s", req.IP)
-	}
-	return nil
+	return normalizeAddrs(req)
 }
 
 // 时间函数
@@ -267,23 +409,47 @@ func findPlaybookFile(dir, base string) (string, bool, error) {
 	return "", false, fmt.Errorf("no playbook found: %s.{yml|yaml}", base)
 }
 
-func selectPlaybook(dir, hostgroup string) (playbook, warn string, err error) {
-	def, defExists, _ := findPlaybookFile(dir, "default")
-	hg, hgExists, _ := findPlaybookFile(dir, hostgroup)
-
-	switch {
-	case defExists && !hgExists:
-		return def, fmt.Sprintf("hostgroup playbook missing: %s.{yml|yaml}; fallback to default", hostgroup), nil
+// playbookCandidates：按层级从具体到通用，prod-goods-ms → prod-goods-ms, prod-goods, prod, default
+func playbookCandidates(hostgroup string) []string {
+	var out []string
+	for hg := hostgroup; hg != ""; {
+		out = append(out, hg)
+		i := strings.LastIndex(hg, "-")
+		if i < 0 {
+			break
+		}
+		hg = hg[:i]
+	}
+	return append(out, "default")
+}
 
-	case !defExists && hgExists:
-		return hg, "", nil
+// selectPlaybook：按层级查找第一个存在的 <name>.{yml|yaml}，没有精确匹配 hostgroup 时给出提示
+func selectPlaybook(dir, hostgroup string) (playbook, warn string, err error) {
+	return selectPlaybookKind(dir, hostgroup, "")
+}
 
-	case defExists && hgExists:
-		return hg, "both default and hostgroup exist; prefer hostgroup", nil
+// selectTeardown：注销时的清理 playbook，<name>.teardown.{yml|yaml}，查找顺序同 selectPlaybook
+func selectTeardown(dir, hostgroup string) (playbook, warn string, err error) {
+	return selectPlaybookKind(dir, hostgroup, ".teardown")
+}
 
-	default:
-		return "", "", fmt.Errorf("neither default nor hostgroup playbook exists under %s (tried .yml/.yaml)", dir)
+func selectPlaybookKind(dir, hostgroup, suffix string) (playbook, warn string, err error) {
+	candidates := playbookCandidates(hostgroup)
+	for i, name := range candidates {
+		p, ok, _ := findPlaybookFile(dir, name+suffix)
+		if !ok {
+			continue
+		}
+		if i > 0 {
+			warn = fmt.Sprintf("hostgroup playbook missing: %s%s.{yml|yaml}; fallback to %s%s", hostgroup, suffix, name, suffix)
+		}
+		return p, warn, nil
+	}
+	for i := range candidates {
+		candidates[i] += suffix
 	}
+	return "", "", fmt.Errorf("no playbook for %s under %s (tried %s, .yml/.yaml)",
+		hostgroup, dir, strings.Join(candidates, ", "))
 }
 
 // 主机注册逻辑
@@ -294,67 +460,75 @@ func (a *App) registerHost(c *gin.Context) {
 		return
 	}
 
-	var req HostReq
-	if err := json.NewDecoder(io.LimitReader(c.Request.Body, 1<<20)).Decode(&req); err != nil {
-		c.String(http.StatusBadRequest, "invalid json")
+	// ?dry_run=true：只演练，等同 /v1/host/plan
+	if dry, _ := strconv.ParseBool(c.Query("dry_run")); dry {
+		a.planHost(c)
 		return
 	}
-	if err := validate(req); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+
+	// 正在退出：不再接受新的注册
+	if a.draining.Load() {
+		a.rejectDraining(c)
 		return
 	}
 
-	// 计算 hostgroup（去掉最后的 -NNN），用于ansible的hostgroup
-	parts := strings.Split(req.Hostname, "-")
-	hostgroup := strings.Join(parts[:len(parts)-1], "-")
-
-	// 流式输出（避免一次性缓冲导致代理读超时）
-	w := c.Writer
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	flusher, ok := w.(http.Flusher)
+	req, name, ok := a.bindRegister(c)
 	if !ok {
-		c.String(http.StatusInternalServerError, "streaming unsupported")
 		return
 	}
+	hostgroup := name.Hostgroup
+	lg := loggerOf(c)
+	audit(c, "register")
 
-	// logf：双写到日志文件 + HTTP 响应
-	logf := func(format string, args ...any) {
-		msg := fmt.Sprintf(format, args...)
-		// 写到全局 logger（文件/stderr）
-		log.Println(msg)
-		// 再写回客户端，补一个时间戳，和你控制台里看到的一样
-		fmt.Fprintf(
-			w,
-			"%s %s\n",
-			time.Now().Format("2006/01/02 15:04:05.000000"),
-			msg,
-		)
-		flusher.Flush()
+	// 排队已满：在开始流式输出之前拒绝，客户端按 Retry-After 重试
+	if a.pool.full() {
+		a.rejectQueueFull(c)
+		return
 	}
 
+	// 流式输出（避免一次性缓冲导致代理读超时）
+	logf, ok := startStream(c)
+	if !ok {
+		return
+	}
+	w := c.Writer
 	ctx := c.Request.Context()
 
-	// Redis 锁
-	lockKey := "LOCK__" + req.Hostname
+	// 主机名锁
+	lockKey := lockPrefix + req.Hostname
 	val := req.ID + "__" + req.IP
 	logf("[INFO] trying to register: %s", lockKey)
 
-	okSet, err := a.rdb.HSetNX(ctx, lockKey, "id__ip", val).Result()
+	okSet, err := a.registry().Lock(ctx, req.Hostname, val)
 
 	if err != nil {
-		log.Printf("[ERROR] redis HSetNX failed: %v", err)
-		http.Error(w, "redis error: "+err.Error(), http.StatusInternalServerError)
+		metricRegistrations.WithLabelValues("registry_error").Inc()
+		lg.Error("registry lock failed", "err", err)
+		http.Error(w, "registry error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	if okSet {
+		metricRegistrations.WithLabelValues("registered").Inc()
 		logf("[INFO] registered")
+		err := a.registry().Update(ctx, req.Hostname, registrationFields(req, name))
+		if err != nil {
+			lg.Error("registry update failed", "err", err)
+		}
+		a.recordHistory(ctx, req.Hostname, HistoryEntry{
+			Action: historyRegister, ID: req.ID, IP: req.IP, Hostgroup: hostgroup,
+			By: credentialOf(c).name(), RequestID: requestIDOf(c),
+		})
 	} else {
-		stored, _ := a.rdb.HGet(ctx, lockKey, "id__ip").Result()
+		stored, _ := a.registry().Owner(ctx, req.Hostname)
 		// 冲突：不同的 ID/IP 抢同一个 hostname
 		if stored != val {
+			metricRegistrations.WithLabelValues("conflict").Inc()
 			logf("[ERROR] registration conflict: stored=%q, incoming=%q", stored, val)
+			a.notifier.send(Event{
+				Event: eventConflict, Hostname: req.Hostname, ID: req.ID, IP: req.IP, Hostgroup: hostgroup,
+				Stored: stored, Credential: credentialOf(c).name(), RequestID: requestIDOf(c),
+			})
 			http.Error(
 				w,
 				fmt.Sprintf("[CONFLICT] already registered by %q, incoming=%q", stored, val),
@@ -362,64 +536,276 @@ func (a *App) registerHost(c *gin.Context) {
 			)
 			return
 		}
-		// 幂等：相同的请求再次进来，放行
+		// 幂等：相同的请求再次进来，放行（同时视为一次续约）
+		metricRegistrations.WithLabelValues("idempotent").Inc()
 		logf("[WARN] already registered (idempotent), stored=%q", stored)
+		err := a.registry().Update(ctx, req.Hostname, map[string]string{
+			fieldLastSeen: time.Now().Format(time.RFC3339Nano),
+		})
+		if err != nil {
+			lg.Error("registry update failed", "err", err)
+		}
+	}
+
+	if _, running := a.teardown.Load(req.Hostname); running {
+		logf("[ERROR] teardown of %s is running", req.Hostname)
+		http.Error(w, "teardown is running, retry later", http.StatusConflict)
+		return
+	}
+
+	// 这台主机的任务还没结束（如 cloud-init 的 curl 断开后重试）：跟随正在运行的任务，不重复执行
+	if j := a.jobs.activeFor(req.Hostname); j != nil {
+		a.attachJob(ctx, c, req, j, logf)
+		return
 	}
 
 	// 选 playbook
-	playbook, warn, err := selectPlaybook(a.cfg.Ansible.Dir, hostgroup)
+	playbook, warn, err := selectPlaybook(name.PlaybookDir, hostgroup)
 	if warn != "" {
 		logf("[WARN] %s", warn)
 	}
 	if err != nil {
-		log.Printf("[ERROR] selectPlaybook failed: %v", err)
+		lg.Error("select playbook failed", "err", err)
 		http.Error(w, "playbook select error: "+err.Error(), http.StatusNotFound)
 		return
 	}
 	logf("[INFO] use playbook: %s", playbook)
 
 	// 写 inventory 文件
-	if err := os.MkdirAll(a.cfg.Ansible.Log, 0o755); err != nil {
-		log.Printf("[ERROR] mkdir log_dir failed: %v", err)
+	if err := os.MkdirAll(a.logDir, 0o755); err != nil {
+		lg.Error("mkdir log dir failed", "err", err)
 		http.Error(w, "mkdir log_dir: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	invBase := fmt.Sprintf("%s__%s__%s.txt", req.ID, req.Hostname, req.IP)
-	invPath := filepath.Join(a.cfg.Ansible.Log, invBase)
-	if err := os.WriteFile(invPath, []byte("["+hostgroup+"]\n"+req.IP+"\n"), 0o644); err != nil {
-		log.Printf("[ERROR] write inventory failed: %v", err)
+	invPath := a.inventoryPath(req)
+	if err := os.WriteFile(invPath, []byte(hostInventory(hostgroup, req.IP)), 0o644); err != nil {
+		lg.Error("write inventory failed", "err", err)
 		http.Error(w, "write inventory: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	logf("[INFO] inventory written: %s", invPath)
 
-	// 步骤 1：设置主机名（通过 ansible 模块 shell）
-	hostnameCmd := fmt.Sprintf(
-		"ansible -u %s %s -i %s -m shell -a 'hostnamectl set-hostname %s'",
-		a.cfg.Ansible.User, req.IP, invPath, req.Hostname,
-	)
-	// timeout=0，等ansible命令执行完或执行过程中报错
-	if err := a.runAndStream(ctx, hostnameCmd, w, logf); err != nil {
-		log.Printf("[ERROR] hostname step failed: %v", err)
-		http.Error(w, "hostname step failed: "+err.Error(), http.StatusInternalServerError)
+	// 创建任务：后续步骤在后台执行，客户端断开不影响 ansible 运行
+	job, err := a.jobs.create(req, name, playbook, invPath, credentialOf(c).name(), requestIDOf(c))
+	if errors.Is(err, errJobActive) {
+		// 并发的重复请求刚刚创建了任务
+		if j := a.jobs.activeFor(req.Hostname); j != nil {
+			a.attachJob(ctx, c, req, j, logf)
+			return
+		}
+	}
+	if err != nil {
+		lg.Error("create job failed", "err", err)
+		http.Error(w, "create job: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	logf("[INFO] job created: %s (status: /v1/jobs/%s, log: /v1/jobs/%s/log)", job.ID, job.ID, job.ID)
+
+	// 交给 batcher：未开启合并时立即入队，开启时等待同组主机凑批
+	a.batcher.add(job)
 
-	// 步骤 2：执行 playbook 并 tee 到日志
-	logFile := strings.TrimSuffix(invPath, ".txt") +
-		"__" + time.Now().Format("2006-01-02_15:04:05.000000") + ".log"
+	// 跟随任务日志，把输出流式回写给客户端
+	if err := followJob(ctx, job, w); err != nil {
+		if errors.Is(err, errClientGone) {
+			job.log.Warn("client disconnected, job keeps running")
+			return
+		}
+		job.log.Error("follow job failed", "err", err)
+	}
+}
 
-	playbookCmd := fmt.Sprintf(
-		"cd %s && ansible-playbook %s -i %s -e hosts=%s 2>&1 | tee %s",
-		a.cfg.Ansible.Dir, playbook, invPath, hostgroup, logFile,
-	)
-	if err := a.runAndStream(ctx, playbookCmd, w, logf); err != nil {
-		log.Printf("[ERROR] playbook step failed: %v", err)
-		http.Error(w, "playbook step failed: "+err.Error(), http.StatusInternalServerError)
+// attachJob：把重复的注册请求挂到这台主机正在运行的任务上；任务属于另一个 ID/IP（锁已被释放后重新注册）时返回冲突
+func (a *App) attachJob(ctx context.Context, c *gin.Context, req HostReq, j *Job, logf func(string, ...any)) {
+	snap := j.snapshot()
+	if snap.HostID != req.ID || snap.IP != req.IP {
+		logf("[ERROR] job %s of previous owner %s__%s is still %s", snap.ID, snap.HostID, snap.IP, snap.State)
+		http.Error(c.Writer, fmt.Sprintf("job %s of previous owner is still %s, retry later", snap.ID, snap.State), http.StatusConflict)
 		return
 	}
+	logf("[INFO] job %s is still %s, follow it (log: /v1/jobs/%s/log)", snap.ID, snap.State, snap.ID)
+	if err := followJob(ctx, j, c.Writer); err != nil {
+		if errors.Is(err, errClientGone) {
+			j.log.Warn("client disconnected, job keeps running")
+			return
+		}
+		j.log.Error("follow job failed", "err", err)
+	}
+}
+
+// bindRegister：注册 / 演练共用的请求解析与校验（格式、命名规则、extra vars、权限、调用方校验），
+// 失败时已写好响应
+func (a *App) bindRegister(c *gin.Context) (HostReq, HostName, bool) {
+	var req HostReq
+	dec := json.NewDecoder(io.LimitReader(c.Request.Body, 1<<20))
+	dec.UseNumber() // extra vars 里的数字原样传给 ansible
+	if err := dec.Decode(&req); err != nil {
+		c.String(http.StatusBadRequest, "invalid json")
+		return req, HostName{}, false
+	}
+	if err := validate(&req); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return req, HostName{}, false
+	}
+	// 按命名规则校验 ID / hostname，并解析出 hostgroup
+	name, err := a.parseName(req.ID, req.Hostname)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return req, name, false
+	}
+	if err := checkRequestVars(a.config().Ansible.RequestVars, name.Hostgroup, req.Vars, req.Tags); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return req, name, false
+	}
+
+	// 这次请求的每一行日志都带上 request_id / host_id / hostname / ip / hostgroup
+	lg := loggerOf(c).With("host_id", req.ID, "hostname", req.Hostname, "ip", req.IP, "hostgroup", name.Hostgroup)
+	c.Set(ctxLogger, lg)
+
+	if !authorize(c, req, name.Hostgroup) {
+		return req, name, false
+	}
+	// 校验调用方就是被注册的主机（在拿锁之前）
+	if err := a.verifyCaller(c.Request, req); err != nil {
+		lg.Warn("verify caller failed", "remote", c.Request.RemoteAddr, "err", err)
+		c.String(http.StatusForbidden, "caller verification failed: "+err.Error())
+		return req, name, false
+	}
+	return req, name, true
+}
+
+// startStream：设置流式响应头，返回双写到日志 + HTTP 响应的 logf；不支持流式时已写好响应
+func startStream(c *gin.Context) (func(string, ...any), bool) {
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		c.String(http.StatusInternalServerError, "streaming unsupported")
+		return nil, false
+	}
+
+	lg := loggerOf(c)
+	return func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		// 写到全局 logger（文件/stderr）
+		logLine(lg, msg)
+		// 再写回客户端，补一个时间戳，和你控制台里看到的一样
+		fmt.Fprintf(
+			w,
+			"%s %s\n",
+			time.Now().Format("2006/01/02 15:04:05.000000"),
+			msg,
+		)
+		flusher.Flush()
+	}, true
+}
+
+// inventoryPath：注册时写入的 inventory 文件
+func (a *App) inventoryPath(req HostReq) string {
+	return filepath.Join(a.logDir, fmt.Sprintf("%s__%s__%s.txt", req.ID, req.Hostname, req.IP))
+}
+
+// registrationFields：加锁成功后写入主机记录的附加字段
+func registrationFields(req HostReq, name HostName) map[string]string {
+	return map[string]string{
+		fieldHostgroup:    name.Hostgroup,
+		fieldPolicy:       name.Policy,
+		fieldEnv:          name.Env,
+		fieldIndex:        name.Index,
+		fieldAddresses:    addrsField(req.Addresses),
+		fieldRegisteredAt: time.Now().Format(time.RFC3339Nano),
+	}
+}
+
+// hostInventory：单台主机的 inventory 内容
+func hostInventory(hostgroup, ip string) string {
+	return "[" + hostgroup + "]\n" + ip + "\n"
+}
+
+// 队列已满：503 + Retry-After
+func (a *App) rejectQueueFull(c *gin.Context) {
+	retry := mustDur(a.config().Ansible.RetryAfter, 30*time.Second)
+	loggerOf(c).Warn("run queue is full, reject", "queued", a.pool.queued(), "path", c.Request.URL.Path)
+	c.Header("Retry-After", strconv.Itoa(int(retry.Seconds())))
+	c.String(http.StatusServiceUnavailable, "run queue is full, retry after %s", retry)
+}
+
+// 步骤 1：设置主机名（ansible command 模块，远端不经过 shell）
+func (a *App) hostnameStep(ctx context.Context, job *Job) error {
+	argv := []string{
+		"ansible", "-u", a.config().Ansible.User, job.IP, "-i", job.Inventory,
+		"-m", "command", "-a", "hostnamectl set-hostname " + job.Hostname,
+	}
+	// timeout=0，等ansible命令执行完或执行过程中报错
+	if err := a.runAndStream(ctx, command{Argv: argv}, job, job.logf); err != nil {
+		job.logf("[ERROR] hostname step failed: %v", err)
+		return fmt.Errorf("hostname step: %w", err)
+	}
+	return nil
+}
 
-	logf("[INFO] initialize host done. log=%s", logFile)
+// playbookRun：一次 ansible-playbook 运行的参数
+type playbookRun struct {
+	Dir       string // 工作目录，空 = ansible.dir
+	Playbook  string
+	Inventory string
+	Hostgroup string
+	Vars      map[string]any // 请求携带的 extra vars，以 JSON 形式 -e 传入
+	Tags      []string
+	StartAt   string // --start-at-task，重试时从指定 task 开始
+	Check     bool   // --check --diff 演练，使用 ansible 默认输出便于阅读 diff
+}
+
+// playbookCommand：按运行参数拼出 ansible-playbook 命令
+func (a *App) playbookCommand(r playbookRun) (command, error) {
+	dir := r.Dir
+	if dir == "" {
+		dir = a.config().Ansible.Dir
+	}
+	argv := []string{"ansible-playbook", r.Playbook, "-i", r.Inventory, "-e", "hosts=" + r.Hostgroup}
+	if len(r.Vars) > 0 {
+		b, err := json.Marshal(r.Vars)
+		if err != nil {
+			return command{}, fmt.Errorf("encode extra vars: %w", err)
+		}
+		argv = append(argv, "-e", string(b))
+	}
+	if len(r.Tags) > 0 {
+		argv = append(argv, "--tags", strings.Join(r.Tags, ","))
+	}
+	if r.StartAt != "" {
+		argv = append(argv, "--start-at-task", r.StartAt)
+	}
+	cmd := command{
+		Dir:  dir,
+		Argv: argv,
+	}
+	switch cb := a.stdoutCallback(); {
+	case r.Check:
+		cmd.Argv = append(cmd.Argv, "--check", "--diff")
+		cmd.Env = []string{"ANSIBLE_STDOUT_CALLBACK=default"}
+	case cb != "default":
+		cmd.Env = []string{"ANSIBLE_STDOUT_CALLBACK=" + cb}
+	}
+	return cmd, nil
+}
+
+// 步骤 2：在 ansible 目录下执行 playbook，输出由任务日志落盘
+func (a *App) playbookStep(ctx context.Context, r playbookRun, w io.Writer, logf func(string, ...any)) error {
+	hostgroup := r.Hostgroup
+	cmd, err := a.playbookCommand(r)
+	if err != nil {
+		logf("[ERROR] playbook step failed: %v", err)
+		return err
+	}
+	start := time.Now()
+	err = a.runAndStream(ctx, cmd, w, logf)
+	metricPlaybookDuration.WithLabelValues(hostgroup).Observe(time.Since(start).Seconds())
+	if err != nil {
+		logf("[ERROR] playbook step failed: %v", err)
+		return err
+	}
+	return nil
 }
 
 // 解除注册：清理 Redis 键，便于后续重新注册（迁移/重装主机）
@@ -435,37 +821,91 @@ func (a *App) unregisterHost(c *gin.Context) {
 		return
 	}
 	// 复用和 register 一样的校验逻辑：ID / Hostname / IP 都必填且格式正确
-	if err := validate(req); err != nil {
+	if err := validate(&req); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	name, err := a.nameOf(c.Request.Context(), req.ID, req.Hostname)
+	if err != nil {
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
+	hostgroup := name.Hostgroup
+	lg := loggerOf(c).With("host_id", req.ID, "hostname", req.Hostname, "ip", req.IP, "hostgroup", hostgroup)
+	c.Set(ctxLogger, lg)
 
-	lockKey := "LOCK__" + req.Hostname
+	if !authorize(c, req, hostgroup) {
+		return
+	}
+	audit(c, "unregister")
+
+	lockKey := lockPrefix + req.Hostname
 	ctx := c.Request.Context()
 
-	// 必须和 Redis 里存的一致才允许删除
+	// 必须和注册时存的一致才允许删除
 	incoming := req.ID + "__" + req.IP
-	stored, _ := a.rdb.HGet(ctx, lockKey, "id__ip").Result()
+	stored, err := a.registry().Owner(ctx, req.Hostname)
+	if err != nil {
+		metricUnregistrations.WithLabelValues("registry_error").Inc()
+		lg.Error("registry get failed", "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
 	if stored != incoming {
-		log.Printf("[WARN] unregister mismatch: stored=%q incoming=%q", stored, incoming)
+		metricUnregistrations.WithLabelValues("mismatch").Inc()
+		lg.Warn("unregister mismatch", "stored", stored, "incoming", incoming)
 		c.String(http.StatusPreconditionFailed, "mismatch: stored=%q incoming=%q", stored, incoming)
 		return
 	}
 
-	_, _ = a.rdb.Del(ctx, lockKey).Result()
-	log.Printf("[INFO] unregister ok: %s", lockKey)
+	// ?teardown=true：先执行清理 playbook，成功（或 force=true）后才释放锁
+	if teardown, _ := strconv.ParseBool(c.Query("teardown")); teardown {
+		force, _ := strconv.ParseBool(c.Query("force"))
+		a.unregisterWithTeardown(c, req, name, force)
+		return
+	}
+
+	if err := a.releaseHost(ctx, c, req, hostgroup, "released"); err != nil {
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
 	c.JSON(http.StatusOK, map[string]any{
 		"ok":      true,
 		"deleted": lockKey,
 	})
 }
 
-// 封闭执行shell命令函数
-func (a *App) runAndStream(ctx context.Context, shellCmd string, w http.ResponseWriter, logf func(string, ...any)) error {
-	logf("[INFO] run: %s", shellCmd)
+// playbook 使用的 stdout 回调，"default" 表示 ansible 默认的文本输出
+func (a *App) stdoutCallback() string {
+	if cb := a.config().Ansible.StdoutCallback; cb != "" {
+		return cb
+	}
+	return defaultStdoutCallback
+}
 
-	c := ctx
-	cmd := exec.CommandContext(c, "/bin/bash", "-lc", shellCmd)
+// command：待执行的命令，Dir 为空时使用当前目录，Env 追加到当前进程环境变量之后
+type command struct {
+	Dir  string
+	Env  []string
+	Argv []string
+}
+
+// 执行命令并流式输出：直接按 argv 启动（不经过 shell）
+func (a *App) runAndStream(ctx context.Context, c command, w io.Writer, logf func(string, ...any)) error {
+	logf("[INFO] run: %s", quoteArgs(append(append([]string(nil), c.Env...), c.Argv...)))
+
+	cmd := exec.CommandContext(ctx, c.Argv[0], c.Argv[1:]...)
+	cmd.Dir = c.Dir
+	// 独立进程组：终端 Ctrl-C 不会直接打到 ansible；被取消时给整个进程组发 SIGTERM，
+	// 给 ansible 收尾的时间，30s 后仍未退出再 SIGKILL
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 30 * time.Second
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -478,6 +918,8 @@ func (a *App) runAndStream(ctx context.Context, shellCmd string, w http.Response
 	if err := cmd.Start(); err != nil {
 		return err
 	}
+	metricCommands.Inc()
+	defer metricCommands.Dec()
 
 	// 合并两路输出并保持行级刷新
 	merge := func(r io.Reader, prefix string) error {
@@ -508,8 +950,24 @@ func (a *App) runAndStream(ctx context.Context, shellCmd string, w http.Response
 		if errors.Is(err, context.DeadlineExceeded) {
 			return fmt.Errorf("command timeout")
 		}
+		// 被取消（如网关退出）：带上取消原因，便于任务标记为 interrupted
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %v", context.Cause(ctx), err)
+		}
 		return err
 	}
 
 	return nil
 }
+
+// 仅用于日志展示：含空白或引号的参数加引号，方便复制到终端重放
+func quoteArgs(argv []string) string {
+	out := make([]string, len(argv))
+	for i, arg := range argv {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`") {
+			arg = strconv.Quote(arg)
+		}
+		out[i] = arg
+	}
+	return strings.Join(out, " ")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestApp：使用 memory 后端的 App，不连接 redis、不执行 ansible
+func newTestApp(t *testing.T, setup func(*Config)) (*App, *gin.Engine) {
+	t.Helper()
+	cfg := Config{
+		Registry: RegistryCfg{Backend: "memory"},
+		Ansible:  AnsibleCfg{Dir: t.TempDir(), Log: t.TempDir()},
+	}
+	if setup != nil {
+		setup(&cfg)
+	}
+	naming, err := compileNaming(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := newRegistry(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &App{
+		logDir: cfg.Ansible.Log,
+		jobs:   newJobStore(filepath.Join(cfg.Ansible.Log, "jobs")),
+		pool:   newPool(cfg.Ansible),
+	}
+	a.state.Store(&appState{cfg: cfg, reg: reg, naming: naming})
+	a.ctx, a.cancel = context.WithCancelCause(context.Background())
+	a.notifier = newNotifier(a)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/host/register", a.registerHost)
+	r.POST("/v1/host/unregister", a.unregisterHost)
+	return a, r
+}
+
+func serve(r http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestRegisterConflict(t *testing.T) {
+	a, r := newTestApp(t, nil)
+	ctx := context.Background()
+	a.registry().Lock(ctx, "prod-web-001", "biz-a__10.0.0.1")
+
+	w := serve(r, "POST", "/v1/host/register", `{"ID":"biz-b","Hostname":"prod-web-001","IP":"10.0.0.2"}`)
+	if !strings.Contains(w.Body.String(), `[CONFLICT] already registered by "biz-a__10.0.0.1"`) {
+		t.Fatalf("body = %s", w.Body.String())
+	}
+	if owner, _ := a.registry().Owner(ctx, "prod-web-001"); owner != "biz-a__10.0.0.1" {
+		t.Fatalf("owner = %q", owner)
+	}
+}
+
+func TestUnregisterHost(t *testing.T) {
+	a, r := newTestApp(t, nil)
+	ctx := context.Background()
+	a.registry().Lock(ctx, "prod-web-001", "biz-a__10.0.0.1")
+
+	w := serve(r, "POST", "/v1/host/unregister", `{"ID":"biz-b","Hostname":"prod-web-001","IP":"10.0.0.1"}`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("mismatch: code = %d, body = %s", w.Code, w.Body.String())
+	}
+	w = serve(r, "POST", "/v1/host/unregister", `{"ID":"biz-a","Hostname":"prod-web-001"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("missing ip: code = %d", w.Code)
+	}
+
+	w = serve(r, "POST", "/v1/host/unregister", `{"ID":"biz-a","Hostname":"prod-web-001","IP":"10.0.0.1"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unregister: code = %d, body = %s", w.Code, w.Body.String())
+	}
+	if f, _ := a.registry().Get(ctx, "prod-web-001"); f != nil {
+		t.Fatalf("record not deleted: %v", f)
+	}
+}
+
+func TestPlaybookCandidates(t *testing.T) {
+	tests := []struct {
+		hostgroup string
+		want      string
+	}{
+		{"prod-goods-ms", "prod-goods-ms,prod-goods,prod,default"},
+		{"prod", "prod,default"},
+		{"prod_goods-api", "prod_goods-api,prod_goods,default"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(playbookCandidates(tt.hostgroup), ","); got != tt.want {
+			t.Errorf("playbookCandidates(%q) = %s, want %s", tt.hostgroup, got, tt.want)
+		}
+	}
+}
+
+func TestSelectPlaybook(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"prod-goods.yml", "default.yaml", "prod.teardown.yml", "test.yml", "test.yaml"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		hostgroup, suffix string
+		want, warn, err   string
+	}{
+		{"prod-goods", "", "prod-goods.yml", "", ""},
+		{"prod-goods-ms", "", "prod-goods.yml", "fallback to prod-goods", ""},
+		{"order-api", "", "default.yaml", "fallback to default", ""},
+		{"prod-goods-ms", ".teardown", "prod.teardown.yml", "fallback to prod.teardown", ""},
+		{"order-api", ".teardown", "", "", "tried order-api.teardown, order.teardown, default.teardown"},
+		// 同时存在 .yml 和 .yaml 的层级跳过
+		{"test", "", "default.yaml", "fallback to default", ""},
+	}
+	for _, tt := range tests {
+		p, warn, err := selectPlaybookKind(dir, tt.hostgroup, tt.suffix)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s%s: err = %v", tt.hostgroup, tt.suffix, err)
+			}
+			continue
+		}
+		if err != nil || filepath.Base(p) != tt.want || !strings.Contains(warn, tt.warn) || (tt.warn == "") != (warn == "") {
+			t.Errorf("%s%s = %s, %q, %v", tt.hostgroup, tt.suffix, p, warn, err)
+		}
+	}
+}
+
+func TestTakeoverHistory(t *testing.T) {
+	a, r := newTestApp(t, nil)
+	r.POST("/v1/admin/takeover", a.takeover)
+	r.GET("/v1/hosts/:hostname/history", a.getHostHistory)
+	ctx := context.Background()
+	a.registry().Lock(ctx, "prod-web-001", "biz-a__10.0.0.1")
+
+	tests := []struct {
+		body string
+		code int
+		want string
+	}{
+		{`{"Hostname":"prod-web-002","ID":"biz-b","IP":"10.0.0.2"}`, http.StatusNotFound, "host not registered"},
+		{`{"Hostname":"prod-web-001","ID":"biz-b","IP":"10.0.0.2","Expect":"biz-x__10.0.0.9"}`, http.StatusConflict, "owner changed"},
+		{`{"Hostname":"prod-web-001","ID":"biz-b","IP":"10.0.0.2","Reason":"a\nb"}`, http.StatusBadRequest, "invalid reason"},
+		{`{"Hostname":"prod-web-001","ID":"biz-b","IP":"10.0.0.2","Expect":"biz-a__10.0.0.1","Reason":"rebuilt"}`, http.StatusOK, `"ok":true`},
+	}
+	for _, tt := range tests {
+		w := serve(r, "POST", "/v1/admin/takeover", tt.body)
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: code=%d body=%q", tt.body, w.Code, w.Body.String())
+		}
+	}
+	if owner, _ := a.registry().Owner(ctx, "prod-web-001"); owner != "biz-b__10.0.0.2" {
+		t.Fatalf("owner after takeover = %q", owner)
+	}
+
+	// 注销后仍可查询历史
+	w := serve(r, "POST", "/v1/host/unregister", `{"ID":"biz-b","Hostname":"prod-web-001","IP":"10.0.0.2"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unregister: code=%d body=%q", w.Code, w.Body.String())
+	}
+	w = serve(r, "GET", "/v1/hosts/prod-web-001/history", "")
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, `"takeover"`) || !strings.Contains(body, `"unregister"`) || !strings.Contains(body, `"rebuilt"`) {
+		t.Fatalf("history: code=%d body=%q", w.Code, body)
+	}
+	if w := serve(r, "GET", "/v1/hosts/prod%20web/history", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid hostname: code=%d", w.Code)
+	}
+}
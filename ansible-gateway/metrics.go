@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus 指标，GET /metrics 暴露（和 /health 一样不需要认证）
+var (
+	// 注册请求在拿锁阶段的结果：registered / allocated（自动分配）/ idempotent / conflict / registry_error
+	metricRegistrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_gateway_registrations_total",
+		Help: "Registration requests by lock outcome.",
+	}, []string{"outcome"})
+
+	// 注册任务的最终结果：succeeded / failed（playbook 失败）/ interrupted
+	metricJobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_gateway_jobs_total",
+		Help: "Finished registration jobs by hostgroup and state.",
+	}, []string{"hostgroup", "state"})
+
+	metricPlaybookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ansible_gateway_playbook_duration_seconds",
+		Help:    "Duration of ansible-playbook runs by hostgroup.",
+		Buckets: []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	}, []string{"hostgroup"})
+
+	// 正在运行的 ansible / ansible-playbook 进程数
+	metricCommands = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ansible_gateway_running_commands",
+		Help: "Number of ansible commands currently running.",
+	})
+
+	metricRegistryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_gateway_registry_errors_total",
+		Help: "Errors returned by the registry backend (redis/file) by operation.",
+	}, []string{"backend", "op"})
+
+	// 注销请求结果：released / forced（清理失败仍释放）/ teardown_failed / mismatch / registry_error
+	metricUnregistrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_gateway_unregistrations_total",
+		Help: "Unregister requests by outcome.",
+	}, []string{"outcome"})
+
+	// 重试次数：manual（/v1/host/:hostname/retry）/ auto（主机不可达自动重试）
+	metricRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_gateway_retries_total",
+		Help: "Job retries by trigger.",
+	}, []string{"trigger"})
+
+	// 租约过期的注册记录：reaped / reachable（SSH 可达，保留）/ registry_error
+	metricReaped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_gateway_reaped_total",
+		Help: "Expired registrations handled by the reaper, by outcome.",
+	}, []string{"outcome"})
+
+	// 管理员强制改绑：takeover / unchanged（已是目标 ID/IP）/ conflict（期间被修改）/ registry_error
+	metricTakeovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_gateway_takeovers_total",
+		Help: "Admin hostname takeovers by outcome.",
+	}, []string{"outcome"})
+
+	// 外发通知的投递结果：sent / retry（失败后重试）/ failed（放弃）
+	metricNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_gateway_notifications_total",
+		Help: "Outbound notification deliveries by target and outcome.",
+	}, []string{"target", "outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricRegistrations,
+		metricJobs,
+		metricPlaybookDuration,
+		metricCommands,
+		metricRegistryErrors,
+		metricUnregistrations,
+		metricRetries,
+		metricReaped,
+		metricTakeovers,
+		metricNotifications,
+	)
+}
+
+// registerPoolMetrics：运行中 / 排队中的任务数直接从 pool 读取
+func registerPoolMetrics(p *pool) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ansible_gateway_active_runs",
+			Help: "Number of runs holding a slot in the run pool.",
+		}, func() float64 { return float64(p.active()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ansible_gateway_queued_runs",
+			Help: "Number of runs waiting in the run queue.",
+		}, func() float64 { return float64(p.queued()) }),
+	)
+}
+
+// instrumentedRegistry：统计注册表后端返回的错误
+type instrumentedRegistry struct {
+	HostRegistry
+	backend string
+}
+
+func (r instrumentedRegistry) count(op string, err error) {
+	if err != nil {
+		metricRegistryErrors.WithLabelValues(r.backend, op).Inc()
+	}
+}
+
+func (r instrumentedRegistry) Lock(ctx context.Context, hostname, idIP string) (bool, error) {
+	ok, err := r.HostRegistry.Lock(ctx, hostname, idIP)
+	r.count("lock", err)
+	return ok, err
+}
+
+func (r instrumentedRegistry) Owner(ctx context.Context, hostname string) (string, error) {
+	v, err := r.HostRegistry.Owner(ctx, hostname)
+	r.count("owner", err)
+	return v, err
+}
+
+func (r instrumentedRegistry) Release(ctx context.Context, hostname string) error {
+	err := r.HostRegistry.Release(ctx, hostname)
+	r.count("release", err)
+	return err
+}
+
+func (r instrumentedRegistry) ReleaseIf(ctx context.Context, hostname string, match map[string]string) (bool, error) {
+	ok, err := r.HostRegistry.ReleaseIf(ctx, hostname, match)
+	r.count("release_if", err)
+	return ok, err
+}
+
+func (r instrumentedRegistry) Update(ctx context.Context, hostname string, fields map[string]string) error {
+	err := r.HostRegistry.Update(ctx, hostname, fields)
+	r.count("update", err)
+	return err
+}
+
+func (r instrumentedRegistry) Replace(ctx context.Context, hostname, from string, fields map[string]string) (bool, error) {
+	ok, err := r.HostRegistry.Replace(ctx, hostname, from, fields)
+	r.count("replace", err)
+	return ok, err
+}
+
+func (r instrumentedRegistry) Get(ctx context.Context, hostname string) (map[string]string, error) {
+	f, err := r.HostRegistry.Get(ctx, hostname)
+	r.count("get", err)
+	return f, err
+}
+
+func (r instrumentedRegistry) List(ctx context.Context) ([]string, error) {
+	names, err := r.HostRegistry.List(ctx)
+	r.count("list", err)
+	return names, err
+}
+
+func (r instrumentedRegistry) AppendHistory(ctx context.Context, hostname, entry string, max int) error {
+	err := r.HostRegistry.AppendHistory(ctx, hostname, entry, max)
+	r.count("append_history", err)
+	return err
+}
+
+func (r instrumentedRegistry) History(ctx context.Context, hostname string) ([]string, error) {
+	h, err := r.HostRegistry.History(ctx, hostname)
+	r.count("history", err)
+	return h, err
+}
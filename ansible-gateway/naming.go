@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// NamingPolicy：一套主机命名规则。hostname 正则必须带 (?P<hostgroup>...) 命名分组，
+// 可选 (?P<env>...) / (?P<index>...)；正则留空时使用默认规则（<hostgroup>-NNN）
+type NamingPolicy struct {
+	Name        string `yaml:"name"`
+	ID          string `yaml:"id"`           // ID 校验正则
+	Hostname    string `yaml:"hostname"`     // hostname 校验与解析正则
+	PlaybookDir string `yaml:"playbook_dir"` // 该规则使用的 playbook 目录，空 = ansible.dir
+}
+
+type NamingCfg struct {
+	// 按顺序匹配 hostname，第一个匹配的规则生效；为空时只有默认规则
+	Policies []NamingPolicy `yaml:"policies"`
+}
+
+// 默认规则：沿用最初的 idRe / hostnameRe，hostgroup 为去掉最后 -NNN 的部分
+const (
+	defaultIDPattern       = `^[a-zA-Z0-9]+-[a-zA-Z0-9]+(?:-[a-zA-Z0-9]+)*$`
+	defaultHostnamePattern = `^(?P<hostgroup>[a-zA-Z0-9]+-[a-zA-Z0-9]+(?:-[a-zA-Z0-9]+)*)-(?P<index>\d{3})$`
+)
+
+// 查询接口里只做字符检查，具体格式由命名规则决定
+var hostnameCharsRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,252}$`)
+
+// 从 hostname 解析出的字段会写进 inventory、playbook 文件名和 ansible 参数，
+// 不管命名规则的正则怎么写，都只允许这些字符
+var (
+	hostgroupCharsRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,127}$`)
+	nameFieldCharsRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{0,64}$`)
+)
+
+// ID 同样写进 inventory / 任务日志的文件名，并和 IP 用 "__" 拼成锁的值，因此也不能含 "__"
+var idCharsRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,127}$`)
+
+func validID(id string) bool {
+	return idCharsRe.MatchString(id) && !strings.Contains(id, "__")
+}
+
+type namingPolicy struct {
+	name        string
+	id          *regexp.Regexp
+	hostname    *regexp.Regexp
+	playbookDir string
+}
+
+// HostName：按命名规则从 hostname 解析出的信息
+type HostName struct {
+	Policy      string
+	Hostgroup   string
+	Env         string
+	Index       string
+	PlaybookDir string
+}
+
+// compileNaming：编译命名规则，列出全部错误
+func compileNaming(cfg Config) ([]*namingPolicy, error) {
+	policies := cfg.Naming.Policies
+	if len(policies) == 0 {
+		policies = []NamingPolicy{{Name: "default"}}
+	}
+
+	var errs []error
+	out := make([]*namingPolicy, 0, len(policies))
+	for i, p := range policies {
+		name := p.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		idPat, hostPat := p.ID, p.Hostname
+		if idPat == "" {
+			idPat = defaultIDPattern
+		}
+		if hostPat == "" {
+			hostPat = defaultHostnamePattern
+		}
+
+		np := &namingPolicy{name: name, playbookDir: p.PlaybookDir}
+		var err error
+		if np.id, err = regexp.Compile(idPat); err != nil {
+			errs = append(errs, fmt.Errorf("naming.policies[%s].id: %w", name, err))
+		}
+		if np.hostname, err = regexp.Compile(hostPat); err != nil {
+			errs = append(errs, fmt.Errorf("naming.policies[%s].hostname: %w", name, err))
+		} else if np.hostname.SubexpIndex("hostgroup") < 0 {
+			errs = append(errs, fmt.Errorf("naming.policies[%s].hostname: missing (?P<hostgroup>...) group", name))
+		}
+		if np.playbookDir == "" {
+			np.playbookDir = cfg.Ansible.Dir
+		} else if fi, err := os.Stat(np.playbookDir); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("naming.policies[%s].playbook_dir: %s is not a directory", name, np.playbookDir))
+		}
+		out = append(out, np)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// parseName：找到第一个匹配 hostname 的规则，再用该规则校验 ID
+func (a *App) parseName(id, hostname string) (HostName, error) {
+	if !validID(id) {
+		return HostName{}, fmt.Errorf("invalid id: %q", id)
+	}
+	if !hostnameCharsRe.MatchString(hostname) {
+		return HostName{}, fmt.Errorf("invalid hostname: %q", hostname)
+	}
+	for _, p := range a.state.Load().naming {
+		m := p.hostname.FindStringSubmatch(hostname)
+		if m == nil {
+			continue
+		}
+		if !p.id.MatchString(id) {
+			return HostName{}, fmt.Errorf("invalid id for naming policy %s: %s", p.name, id)
+		}
+		group := func(name string) string {
+			if i := p.hostname.SubexpIndex(name); i >= 0 {
+				return m[i]
+			}
+			return ""
+		}
+		hn := HostName{
+			Policy:      p.name,
+			Hostgroup:   group("hostgroup"),
+			Env:         group("env"),
+			Index:       group("index"),
+			PlaybookDir: p.playbookDir,
+		}
+		if hn.Hostgroup == "" {
+			return HostName{}, fmt.Errorf("naming policy %s: empty hostgroup for %s", p.name, hostname)
+		}
+		if !hostgroupCharsRe.MatchString(hn.Hostgroup) || !nameFieldCharsRe.MatchString(hn.Env) || !nameFieldCharsRe.MatchString(hn.Index) {
+			return HostName{}, fmt.Errorf("naming policy %s: invalid hostgroup/env/index parsed from %s", p.name, hostname)
+		}
+		return hn, nil
+	}
+	return HostName{}, fmt.Errorf("invalid hostname: %s (no naming policy matches)", hostname)
+}
+
+// nameOf：注销等针对已注册主机的操作使用。命名规则改过、hostname 已不再匹配时，
+// 退回注册表里记录的 hostgroup 和命名规则（规则已删除时用 ansible.dir），避免主机无法注销
+func (a *App) nameOf(ctx context.Context, id, hostname string) (HostName, error) {
+	name, err := a.parseName(id, hostname)
+	if err == nil || !validID(id) {
+		return name, err
+	}
+	f, gerr := a.registry().Get(ctx, hostname)
+	if gerr != nil || f == nil {
+		return HostName{}, err
+	}
+	rec := recordOf(hostname, f)
+	dir := a.config().Ansible.Dir
+	for _, p := range a.state.Load().naming {
+		if p.name == rec.Policy {
+			dir = p.playbookDir
+			break
+		}
+	}
+	return HostName{
+		Policy:      rec.Policy,
+		Hostgroup:   rec.Hostgroup,
+		Env:         rec.Env,
+		Index:       rec.Index,
+		PlaybookDir: dir,
+	}, nil
+}
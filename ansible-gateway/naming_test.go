@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func namingApp(t *testing.T, policies []NamingPolicy) *App {
+	t.Helper()
+	a, _ := newTestApp(t, func(cfg *Config) { cfg.Naming.Policies = policies })
+	return a
+}
+
+func TestCompileNaming(t *testing.T) {
+	dir := t.TempDir()
+	naming, err := compileNaming(Config{Ansible: AnsibleCfg{Dir: dir}})
+	if err != nil || len(naming) != 1 || naming[0].name != "default" || naming[0].playbookDir != dir {
+		t.Fatalf("default policy: %+v, %v", naming, err)
+	}
+
+	_, err = compileNaming(Config{Naming: NamingCfg{Policies: []NamingPolicy{
+		{Name: "bad-id", ID: "(", Hostname: `^(?P<hostgroup>.+)$`},
+		{Name: "no-group", Hostname: `^(.+)-\d+$`},
+		{Hostname: `^(?P<hostgroup>.+)$`, PlaybookDir: dir + "/missing"},
+	}}})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	// 一次列出全部问题，未命名的规则用序号
+	for _, s := range []string{
+		"naming.policies[bad-id].id",
+		"naming.policies[no-group].hostname: missing (?P<hostgroup>...) group",
+		"naming.policies[#2].playbook_dir",
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error missing %q: %v", s, err)
+		}
+	}
+}
+
+func TestParseName(t *testing.T) {
+	teamDir := t.TempDir()
+	a := namingApp(t, []NamingPolicy{
+		{Name: "team-b", ID: `^team-b$`, Hostname: `^(?P<hostgroup>[a-z]+-[a-z]+)-(?P<index>\d{2})-(?P<env>prod|test)$`, PlaybookDir: teamDir},
+		// 宽松的规则：字符限制仍然生效
+		{Name: "loose", ID: `.+`, Hostname: `^loose-(?P<hostgroup>.+)-(?P<index>.*)$`},
+		{Name: "default"},
+	})
+	def := a.config().Ansible.Dir
+
+	tests := []struct {
+		id, hostname string
+		want         HostName
+		err          string
+	}{
+		{"biz-goods", "prod-goods-ms-001", HostName{Policy: "default", Hostgroup: "prod-goods-ms", Index: "001", PlaybookDir: def}, ""},
+		{"team-b", "goods-api-01-prod", HostName{Policy: "team-b", Hostgroup: "goods-api", Env: "prod", Index: "01", PlaybookDir: teamDir}, ""},
+		{"biz-goods", "goods-api-01-prod", HostName{}, "invalid id for naming policy team-b"},
+		{"biz_goods", "prod-goods-ms-001", HostName{}, "invalid id for naming policy default"},
+		{"biz-goods", "prod-goods-ms-01", HostName{}, "no naming policy matches"},
+		{"biz-goods", "../etc-001", HostName{}, "invalid hostname"},
+		{"a.b", "loose-web-1", HostName{Policy: "loose", Hostgroup: "web", Index: "1", PlaybookDir: def}, ""},
+		// ID 会进文件名和锁的值
+		{"../x", "loose-web-1", HostName{}, "invalid id"},
+		{"a/b", "loose-web-1", HostName{}, "invalid id"},
+		{"a__b", "loose-web-1", HostName{}, "invalid id"},
+		{".hidden", "loose-web-1", HostName{}, "invalid id"},
+		// 宽松规则解析出的 hostgroup / index 仍按字符集检查
+		{"a", "loose-web.x-1", HostName{}, "invalid hostgroup/env/index"},
+		{"a", "loose-web-1.2", HostName{}, "invalid hostgroup/env/index"},
+	}
+	for _, tt := range tests {
+		got, err := a.parseName(tt.id, tt.hostname)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseName(%q, %q) err = %v, want %q", tt.id, tt.hostname, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseName(%q, %q) = %+v, %v", tt.id, tt.hostname, got, err)
+		}
+	}
+}
+
+func TestNameOfFallback(t *testing.T) {
+	teamDir := t.TempDir()
+	a := namingApp(t, []NamingPolicy{
+		{Name: "team-b", ID: `^team-b$`, Hostname: `^(?P<hostgroup>[a-z]+-[a-z]+)-(?P<index>\d{2})$`, PlaybookDir: teamDir},
+	})
+	ctx := context.Background()
+	// 注册时的规则后来改过，hostname 已不匹配
+	a.registry().Lock(ctx, "goods-api-01-prod", "team-b__10.0.0.1")
+	a.registry().Update(ctx, "goods-api-01-prod", map[string]string{fieldPolicy: "team-b", fieldHostgroup: "goods-api"})
+	a.registry().Lock(ctx, "old-api-01-prod", "team-b__10.0.0.2")
+	a.registry().Update(ctx, "old-api-01-prod", map[string]string{fieldPolicy: "removed", fieldHostgroup: "old-api"})
+
+	name, err := a.nameOf(ctx, "team-b", "goods-api-01-prod")
+	if err != nil || name.Hostgroup != "goods-api" || name.PlaybookDir != teamDir {
+		t.Errorf("fallback = %+v, %v", name, err)
+	}
+	// 规则已删除：用 ansible.dir
+	name, err = a.nameOf(ctx, "team-b", "old-api-01-prod")
+	if err != nil || name.Hostgroup != "old-api" || name.PlaybookDir != a.config().Ansible.Dir {
+		t.Errorf("removed policy = %+v, %v", name, err)
+	}
+	// 没有记录或 ID 非法时不回退
+	if _, err := a.nameOf(ctx, "team-b", "new-api-01-prod"); err == nil {
+		t.Error("unregistered host accepted")
+	}
+	if _, err := a.nameOf(ctx, "../x", "goods-api-01-prod"); err == nil {
+		t.Error("invalid id accepted through fallback")
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NotifyCfg：注册结果的外发通知（通用 webhook / 企业微信机器人），没有 targets 时不发送
+type NotifyCfg struct {
+	Timeout      string         `yaml:"timeout"`       // 单次投递超时，默认 5s
+	Retries      int            `yaml:"retries"`       // 投递失败后的重试次数，默认 3，-1 表示不重试
+	RetryBackoff string         `yaml:"retry_backoff"` // 首次重试的间隔，之后翻倍，默认 2s
+	Targets      []NotifyTarget `yaml:"targets"`
+}
+
+// NotifyTarget：一个通知目标，按 events / hostgroups 路由（均为空时接收全部通知）
+type NotifyTarget struct {
+	Name        string            `yaml:"name"`
+	Type        string            `yaml:"type"`         // webhook（默认）/ wecom
+	URL         string            `yaml:"url"`          // wecom 可省略，按 key 拼出机器人地址
+	Key         string            `yaml:"key"`          // wecom 机器人的 key
+	KeyFile     string            `yaml:"key_file"`     // 从文件读取 key
+	Headers     map[string]string `yaml:"headers"`      // webhook 附加的请求头，如 Authorization
+	HeaderFiles map[string]string `yaml:"header_files"` // 从文件读取请求头的值（请求头名 → 文件），与 headers 中的同名项二选一
+	Events      []string          `yaml:"events"`       // success / failure / conflict / unregister
+	Hostgroups  []string          `yaml:"hostgroups"`   // path.Match 通配
+}
+
+// 通知事件
+const (
+	eventSuccess    = "success"    // 注册任务成功
+	eventFailure    = "failure"    // 注册任务失败 / 被中断
+	eventConflict   = "conflict"   // hostname 已被其它 ID/IP 注册
+	eventUnregister = "unregister" // 注销（含强制释放、过期回收）
+)
+
+var notifyEvents = []string{eventSuccess, eventFailure, eventConflict, eventUnregister}
+
+const wecomWebhook = "https://qyapi.weixin.qq.com/cgi-bin/webhook/send?key="
+
+// 同时在途的投递数，避免大批主机同时结束时瞬间打满机器人的频率限制
+const maxNotifyInflight = 8
+
+// Event：通知内容，webhook 目标原样以 JSON POST
+type Event struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Hostname   string    `json:"hostname"`
+	ID         string    `json:"id"`
+	IP         string    `json:"ip"`
+	Hostgroup  string    `json:"hostgroup"`
+	Job        string    `json:"job,omitempty"`
+	State      string    `json:"state,omitempty"` // 任务状态 succeeded / failed / interrupted
+	Step       string    `json:"step,omitempty"`  // 失败的步骤
+	FailedTask string    `json:"failed_task,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Recap      string    `json:"recap,omitempty"`
+	Log        string    `json:"log,omitempty"`
+	Stored     string    `json:"stored,omitempty"`  // conflict：当前持有者 id__ip
+	Outcome    string    `json:"outcome,omitempty"` // unregister：released / forced / reaped
+	Credential string    `json:"credential,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// notifier：异步投递通知，失败按退避重试；不阻塞注册流程
+type notifier struct {
+	app *App
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+func newNotifier(app *App) *notifier {
+	return &notifier{app: app, sem: make(chan struct{}, maxNotifyInflight)}
+}
+
+// routes：目标是否接收该事件
+func (t NotifyTarget) routes(ev Event) bool {
+	return (len(t.Events) == 0 || slices.Contains(t.Events, ev.Event)) && matchAny(t.Hostgroups, ev.Hostgroup)
+}
+
+// send：按当前配置路由到各个目标后台投递；网关退出时在 shutdown 中等待在途的通知
+func (n *notifier) send(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	cfg := n.app.config().Notify
+	for _, t := range cfg.Targets {
+		if !t.routes(ev) {
+			continue
+		}
+		n.wg.Add(1)
+		go n.deliver(cfg, t, ev)
+	}
+}
+
+func (n *notifier) deliver(cfg NotifyCfg, t NotifyTarget, ev Event) {
+	defer n.wg.Done()
+	lg := slog.With("target", t.Name, "event", ev.Event, "hostname", ev.Hostname)
+
+	retries := cfg.Retries
+	if retries == 0 {
+		retries = 3
+	}
+	backoff := mustDur(cfg.RetryBackoff, 2*time.Second)
+	timeout := mustDur(cfg.Timeout, 5*time.Second)
+	for attempt := 0; ; attempt++ {
+		n.sem <- struct{}{}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		retry, err := postNotify(ctx, t, ev)
+		cancel()
+		<-n.sem
+		if err == nil {
+			metricNotifications.WithLabelValues(t.Name, "sent").Inc()
+			lg.Debug("notification sent", "attempt", attempt+1)
+			return
+		}
+		err = redactErr(err)
+		if !retry || attempt >= retries {
+			metricNotifications.WithLabelValues(t.Name, "failed").Inc()
+			lg.Error("notification failed", "attempt", attempt+1, "err", err)
+			return
+		}
+		metricNotifications.WithLabelValues(t.Name, "retry").Inc()
+		lg.Warn("notification failed, retry", "attempt", attempt+1, "in", backoff.String(), "err", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// wait：等待在途的通知投递完（包括重试），ctx 到期返回 ctx.Err()
+func (n *notifier) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// redactErr：net/http 的错误里带完整 URL（企业微信的 key 在查询参数里，webhook 的 token 常在路径里），
+// 记日志前只保留 scheme 和 host
+func redactErr(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		ue.URL = redactURL(ue.URL)
+	}
+	return err
+}
+
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return "<redacted>"
+	}
+	return u.Scheme + "://" + u.Host + "/<redacted>"
+}
+
+// postNotify：投递一次，返回值 retry 表示失败是否值得重试（网络错误、5xx、429、机器人限频等）
+func postNotify(ctx context.Context, t NotifyTarget, ev Event) (retry bool, err error) {
+	target := t.URL
+	var body []byte
+	switch t.Type {
+	case "wecom":
+		if target == "" {
+			target = wecomWebhook + url.QueryEscape(t.Key)
+		}
+		body, err = json.Marshal(map[string]any{
+			"msgtype":  "markdown",
+			"markdown": map[string]string{"content": wecomMarkdown(ev)},
+		})
+	default:
+		body, err = json.Marshal(ev)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ansible-gateway")
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+			fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	// 企业微信出错时 HTTP 仍返回 200，错误在 errcode 里
+	if t.Type == "wecom" {
+		var r struct {
+			ErrCode int    `json:"errcode"`
+			ErrMsg  string `json:"errmsg"`
+		}
+		if err := json.Unmarshal(b, &r); err != nil {
+			return true, fmt.Errorf("decode wecom response: %w", err)
+		}
+		if r.ErrCode != 0 {
+			// 45009：接口调用超过限制
+			return r.ErrCode == 45009 || r.ErrCode == -1, fmt.Errorf("wecom errcode %d: %s", r.ErrCode, r.ErrMsg)
+		}
+	}
+	return false, nil
+}
+
+// wecomMarkdown：企业微信 markdown 消息，标题一行 + 每个字段一行引用
+func wecomMarkdown(ev Event) string {
+	title, color := "注册成功", "info"
+	switch ev.Event {
+	case eventFailure:
+		title, color = "注册失败", "warning"
+		if ev.State == string(JobInterrupted) {
+			title = "注册中断"
+		}
+	case eventConflict:
+		title, color = "注册冲突", "warning"
+	case eventUnregister:
+		title, color = "已注销", "comment"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "## <font color=\"%s\">[%s]</font> %s\n", color, title, ev.Hostname)
+	line := func(k, v string) {
+		if v == "" {
+			return
+		}
+		// 错误信息可能很长，消息总长度有 4096 字节的限制
+		if len(v) > 512 {
+			// 按字节截断后去掉被截断的半个字符
+			v = strings.ToValidUTF8(v[:512], "") + "..."
+		}
+		fmt.Fprintf(&b, ">%s：<font color=\"comment\">%s</font>\n", k, v)
+	}
+	line("hostgroup", ev.Hostgroup)
+	line("ID", ev.ID)
+	line("IP", ev.IP)
+	line("job", ev.Job)
+	line("step", ev.Step)
+	line("failed task", ev.FailedTask)
+	line("result", ev.Recap)
+	line("error", ev.Error)
+	line("stored", ev.Stored)
+	line("outcome", ev.Outcome)
+	line("credential", ev.Credential)
+	line("log", ev.Log)
+	line("time", ev.Time.Format("2006-01-02 15:04:05"))
+	return b.String()
+}
+
+// notifyJob：任务结束时发送 success / failure（作为 jobStore.onState 的一部分调用）
+func (a *App) notifyJob(j *Job) {
+	ev := Event{Event: eventFailure}
+	switch j.State {
+	case JobSucceeded:
+		ev.Event = eventSuccess
+	case JobFailed, JobInterrupted:
+		ev.Step = j.Step
+		ev.FailedTask = j.FailedTask
+		ev.Error = j.Error
+	default:
+		return
+	}
+	ev.Hostname, ev.ID, ev.IP, ev.Hostgroup = j.Hostname, j.HostID, j.IP, j.Hostgroup
+	ev.Job, ev.State, ev.Log = j.ID, string(j.State), j.LogPath
+	ev.Credential, ev.RequestID = j.Credential, j.RequestID
+	if j.Recap != nil {
+		ev.Recap = j.Recap.String()
+	}
+	a.notifier.send(ev)
+}
+
+// validateNotify：通知相关配置
+func validateNotify(nc NotifyCfg) []error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if nc.Retries < -1 {
+		add("notify.retries: must be >= -1")
+	}
+	names := map[string]bool{}
+	for i, t := range nc.Targets {
+		if t.Name == "" {
+			add("notify.targets[%d]: name is required", i)
+		} else if names[t.Name] {
+			add("notify.targets[%d]: duplicate name %q", i, t.Name)
+		}
+		names[t.Name] = true
+		switch t.Type {
+		case "", "webhook":
+			if t.URL == "" {
+				add("notify.targets[%d]: url is required", i)
+			}
+		case "wecom":
+			if t.URL == "" && t.Key == "" {
+				add("notify.targets[%d]: one of url/key/key_file is required", i)
+			}
+		default:
+			add("notify.targets[%d]: unknown type %q", i, t.Type)
+		}
+		if t.URL != "" {
+			if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add("notify.targets[%d]: invalid url %q", i, t.URL)
+			}
+		}
+		for _, e := range t.Events {
+			if !slices.Contains(notifyEvents, e) {
+				add("notify.targets[%d]: unknown event %q", i, e)
+			}
+		}
+		for _, p := range t.Hostgroups {
+			if _, err := path.Match(p, ""); err != nil {
+				add("notify.targets[%d]: invalid hostgroup pattern %q", i, p)
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestNotifyTargetRoutes(t *testing.T) {
+	tests := []struct {
+		target NotifyTarget
+		ev     Event
+		want   bool
+	}{
+		{NotifyTarget{}, Event{Event: eventSuccess, Hostgroup: "prod-web"}, true}, // 均为空：接收全部
+		{NotifyTarget{Events: []string{eventFailure, eventConflict}}, Event{Event: eventFailure, Hostgroup: "prod-web"}, true},
+		{NotifyTarget{Events: []string{eventFailure}}, Event{Event: eventSuccess, Hostgroup: "prod-web"}, false},
+		{NotifyTarget{Hostgroups: []string{"prod-*"}}, Event{Event: eventUnregister, Hostgroup: "prod-web"}, true},
+		{NotifyTarget{Hostgroups: []string{"prod-*"}}, Event{Event: eventUnregister, Hostgroup: "test-web"}, false},
+		{NotifyTarget{Events: []string{eventFailure}, Hostgroups: []string{"prod-*"}}, Event{Event: eventFailure, Hostgroup: "test-web"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.target.routes(tt.ev); got != tt.want {
+			t.Errorf("routes(%+v, %s/%s) = %v", tt.target, tt.ev.Event, tt.ev.Hostgroup, got)
+		}
+	}
+}
+
+func TestWecomMarkdown(t *testing.T) {
+	tests := []struct {
+		ev    Event
+		title string
+	}{
+		{Event{Event: eventSuccess}, `<font color="info">[注册成功]</font>`},
+		{Event{Event: eventFailure, State: string(JobFailed)}, `<font color="warning">[注册失败]</font>`},
+		{Event{Event: eventFailure, State: string(JobInterrupted)}, `<font color="warning">[注册中断]</font>`},
+		{Event{Event: eventConflict}, `<font color="warning">[注册冲突]</font>`},
+		{Event{Event: eventUnregister}, `<font color="comment">[已注销]</font>`},
+	}
+	for _, tt := range tests {
+		tt.ev.Hostname = "prod-web-001"
+		if got := wecomMarkdown(tt.ev); !strings.HasPrefix(got, "## "+tt.title+" prod-web-001\n") {
+			t.Errorf("%s: markdown = %q", tt.ev.Event, got)
+		}
+	}
+
+	// 空字段不输出；超长的中文错误按字节截断后仍是合法 UTF-8
+	md := wecomMarkdown(Event{Event: eventFailure, Hostname: "prod-web-001", IP: "10.0.0.1", Error: strings.Repeat("失败", 300)})
+	if !strings.Contains(md, ">IP：<font color=\"comment\">10.0.0.1</font>\n") || strings.Contains(md, ">job：") {
+		t.Fatalf("markdown = %q", md)
+	}
+	if !utf8.ValidString(md) || !strings.Contains(md, "...</font>") || len(md) > 1024 {
+		t.Fatalf("truncated markdown: len=%d valid=%v", len(md), utf8.ValidString(md))
+	}
+}
+
+func TestNotifierDeliver(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string][]string{}
+	wecomCalls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/hook":
+			got["hook"] = append(got["hook"], r.Header.Get("Authorization")+" "+string(b))
+		case "/wecom":
+			// 第一次限频，重试后成功
+			wecomCalls++
+			if wecomCalls == 1 {
+				io.WriteString(w, `{"errcode":45009,"errmsg":"api freq out of limit"}`)
+				return
+			}
+			got["wecom"] = append(got["wecom"], string(b))
+			io.WriteString(w, `{"errcode":0,"errmsg":"ok"}`)
+		case "/bad":
+			got["bad"] = append(got["bad"], string(b))
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	a, _ := newTestApp(t, func(cfg *Config) {
+		cfg.Notify = NotifyCfg{RetryBackoff: "10ms", Targets: []NotifyTarget{
+			{Name: "hook", URL: srv.URL + "/hook", Headers: map[string]string{"Authorization": "Bearer t"}},
+			{Name: "wecom", Type: "wecom", URL: srv.URL + "/wecom", Events: []string{eventFailure}},
+			{Name: "bad", URL: srv.URL + "/bad", Hostgroups: []string{"prod-*"}},
+		}}
+	})
+	a.notifier.send(Event{Event: eventSuccess, Hostname: "test-web-001", Hostgroup: "test-web"})
+	a.notifier.send(Event{Event: eventFailure, Hostname: "prod-web-001", Hostgroup: "prod-web", Error: "boom"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.notifier.wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got["hook"]) != 2 || !strings.HasPrefix(got["hook"][0], "Bearer t ") {
+		t.Fatalf("webhook = %v", got["hook"])
+	}
+	var ev Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(got["hook"][0], "Bearer t ")), &ev); err != nil || ev.Time.IsZero() {
+		t.Fatalf("webhook body: %+v (err %v)", ev, err)
+	}
+	if wecomCalls != 2 || len(got["wecom"]) != 1 || !strings.Contains(got["wecom"][0], `"msgtype":"markdown"`) {
+		t.Fatalf("wecom calls=%d got=%v", wecomCalls, got["wecom"])
+	}
+	// 4xx 不重试，test-web 不路由到 bad
+	if len(got["bad"]) != 1 {
+		t.Fatalf("bad target called %d times", len(got["bad"]))
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 演练时的锁结果：register = 会新注册，idempotent = 已由同一 ID/IP 注册，conflict = 被其它 ID/IP 占用
+const (
+	planLockRegister   = "register"
+	planLockIdempotent = "idempotent"
+	planLockConflict   = "conflict"
+)
+
+// HostPlan：注册请求的演练结果，不加锁、不改主机名、不执行 playbook
+type HostPlan struct {
+	HostID      string   `json:"host_id"`
+	Hostname    string   `json:"hostname"`
+	IP          string   `json:"ip"`
+	Hostgroup   string   `json:"hostgroup"`
+	Policy      string   `json:"policy"`
+	Lock        string   `json:"lock"`
+	Owner       string   `json:"owner,omitempty"` // 已注册时的 id__ip
+	Playbook    string   `json:"playbook,omitempty"`
+	PlaybookDir string   `json:"playbook_dir"`
+	Inventory   string   `json:"inventory"`
+	Command     string   `json:"command,omitempty"` // 注册时将执行的 ansible-playbook 命令
+	Warnings    []string `json:"warnings,omitempty"`
+	Errors      []string `json:"errors,omitempty"` // 实际注册会失败的原因
+	OK          bool     `json:"ok"`
+}
+
+// planHost：POST /v1/host/plan（或 /v1/host/register?dry_run=true）。
+// 默认返回 JSON 演练结果；?check=true 时流式输出演练结果，并执行 ansible-playbook --check --diff
+func (a *App) planHost(c *gin.Context) {
+	req, name, ok := a.bindRegister(c)
+	if !ok {
+		return
+	}
+	lg := loggerOf(c)
+	check, _ := strconv.ParseBool(c.Query("check"))
+	audit(c, "plan")
+
+	ctx := c.Request.Context()
+	p := HostPlan{
+		HostID:      req.ID,
+		Hostname:    req.Hostname,
+		IP:          req.IP,
+		Hostgroup:   name.Hostgroup,
+		Policy:      name.Policy,
+		PlaybookDir: name.PlaybookDir,
+		Inventory:   hostInventory(name.Hostgroup, req.IP),
+	}
+
+	// 锁：只读，不写入
+	stored, err := a.registry().Owner(ctx, req.Hostname)
+	if err != nil {
+		lg.Error("registry owner failed", "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
+	switch stored {
+	case "":
+		p.Lock = planLockRegister
+	case req.ID + "__" + req.IP:
+		p.Lock = planLockIdempotent
+		p.Owner = stored
+		p.Warnings = append(p.Warnings, "already registered (idempotent)")
+	default:
+		p.Lock = planLockConflict
+		p.Owner = stored
+		p.Errors = append(p.Errors, fmt.Sprintf("registration conflict: stored=%q, incoming=%q", stored, req.ID+"__"+req.IP))
+	}
+
+	playbook, warn, err := selectPlaybook(name.PlaybookDir, name.Hostgroup)
+	if warn != "" {
+		p.Warnings = append(p.Warnings, warn)
+	}
+	if err != nil {
+		p.Errors = append(p.Errors, "playbook select error: "+err.Error())
+	}
+	p.Playbook = playbook
+
+	run := playbookRun{
+		Dir:       name.PlaybookDir,
+		Playbook:  playbook,
+		Hostgroup: name.Hostgroup,
+		Vars:      req.Vars,
+		Tags:      req.Tags,
+		Check:     check,
+	}
+	if playbook != "" {
+		run.Inventory = a.inventoryPath(req)
+		if cmd, err := a.playbookCommand(run); err != nil {
+			p.Errors = append(p.Errors, err.Error())
+		} else {
+			p.Command = quoteArgs(append(append([]string(nil), cmd.Env...), cmd.Argv...))
+		}
+	}
+	p.OK = len(p.Errors) == 0
+
+	if !check {
+		c.JSON(http.StatusOK, p)
+		return
+	}
+	a.checkRun(c, p, run)
+}
+
+// checkRun：流式输出演练结果，没有错误时执行 ansible-playbook --check --diff（占用并发名额，不设置主机名）
+func (a *App) checkRun(c *gin.Context, p HostPlan, run playbookRun) {
+	if a.draining.Load() {
+		a.rejectDraining(c)
+		return
+	}
+	if p.OK && a.pool.full() {
+		a.rejectQueueFull(c)
+		return
+	}
+
+	logf, ok := startStream(c)
+	if !ok {
+		return
+	}
+	w := c.Writer
+
+	logf("[INFO] plan: lock=%s playbook=%s", p.Lock, p.Playbook)
+	for _, s := range p.Warnings {
+		logf("[WARN] %s", s)
+	}
+	for _, s := range p.Errors {
+		logf("[ERROR] %s", s)
+	}
+	if !p.OK {
+		logf("[ERROR] plan failed, skip check run")
+		return
+	}
+
+	if err := os.MkdirAll(a.logDir, 0o755); err != nil {
+		logf("[ERROR] mkdir log dir: %v", err)
+		return
+	}
+	f, err := os.CreateTemp(a.logDir, "plan__"+p.Hostname+"__*.txt")
+	if err != nil {
+		logf("[ERROR] write inventory: %v", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(p.Inventory)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logf("[ERROR] write inventory: %v", err)
+		return
+	}
+	run.Inventory = f.Name()
+	logf("[INFO] inventory written: %s", run.Inventory)
+
+	// 客户端断开或网关退出都会终止演练
+	ctx, cancel := context.WithCancelCause(c.Request.Context())
+	defer cancel(nil)
+	stop := context.AfterFunc(a.ctx, func() { cancel(context.Cause(a.ctx)) })
+	defer stop()
+
+	t, err := a.pool.enqueue(p.Hostgroup)
+	if err != nil {
+		logf("[ERROR] enqueue check run: %v", err)
+		return
+	}
+	defer a.pool.release(t)
+	err = a.pool.wait(ctx, t, func(pos, queued int) {
+		logf("[INFO] queued: position %d/%d", pos, queued)
+	})
+	if err != nil {
+		logf("[ERROR] wait for run slot: %v", err)
+		return
+	}
+
+	cmd, err := a.playbookCommand(run)
+	if err == nil {
+		err = a.runAndStream(ctx, cmd, w, logf)
+	}
+	if err != nil {
+		logf("[ERROR] check run failed: %v", err)
+		return
+	}
+	logf("[INFO] check run done")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errQueueFull = errors.New("run queue is full")
+
+// pool：限制同时运行的 ansible 任务数（全局 + 每个 hostgroup），超出的任务按 FIFO 排队
+type pool struct {
+	mu          sync.Mutex
+	maxRunning  int // 0 = 不限
+	maxPerGroup int // 0 = 不限
+	maxQueue    int // 0 = 不限
+
+	running  int
+	perGroup map[string]int
+	queue    []*ticket
+}
+
+// ticket：一个任务在池中的占位，ready 关闭表示轮到它运行
+type ticket struct {
+	group   string
+	ready   chan struct{}
+	started bool
+}
+
+func newPool(cfg AnsibleCfg) *pool {
+	return &pool{
+		maxRunning:  cfg.MaxConcurrent,
+		maxPerGroup: cfg.MaxPerHostgroup,
+		maxQueue:    cfg.MaxQueue,
+		perGroup:    make(map[string]int),
+	}
+}
+
+// setLimits：热加载后更新并发限制，放宽的限制立即放行排队中的任务
+func (p *pool) setLimits(cfg AnsibleCfg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxRunning = cfg.MaxConcurrent
+	p.maxPerGroup = cfg.MaxPerHostgroup
+	p.maxQueue = cfg.MaxQueue
+	p.dispatch()
+}
+
+// full：排队已满，新请求应直接拒绝
+func (p *pool) full() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.maxQueue > 0 && len(p.queue) >= p.maxQueue
+}
+
+// enqueue：进入队尾，有空位时立即放行
+func (p *pool) enqueue(group string) (*ticket, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.maxQueue > 0 && len(p.queue) >= p.maxQueue {
+		return nil, errQueueFull
+	}
+	t := &ticket{group: group, ready: make(chan struct{})}
+	p.queue = append(p.queue, t)
+	p.dispatch()
+	return t, nil
+}
+
+// dispatch：按入队顺序放行，某个 hostgroup 满了就跳过它，不阻塞其它 hostgroup（调用方持锁）
+func (p *pool) dispatch() {
+	kept := p.queue[:0]
+	for _, t := range p.queue {
+		if (p.maxRunning > 0 && p.running >= p.maxRunning) ||
+			(p.maxPerGroup > 0 && p.perGroup[t.group] >= p.maxPerGroup) {
+			kept = append(kept, t)
+			continue
+		}
+		p.running++
+		p.perGroup[t.group]++
+		t.started = true
+		close(t.ready)
+	}
+	for i := len(kept); i < len(p.queue); i++ {
+		p.queue[i] = nil
+	}
+	p.queue = kept
+}
+
+// position：排队位置（从 1 开始），已开始运行返回 0
+func (p *pool) position(t *ticket) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, q := range p.queue {
+		if q == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// wait：等待轮到自己，排队位置变化时通过 report 回报
+func (p *pool) wait(ctx context.Context, t *ticket, report func(pos, queued int)) error {
+	last := -1
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-t.ready:
+			return nil
+		default:
+		}
+
+		if pos := p.position(t); pos != last && pos > 0 {
+			report(pos, p.queued())
+			last = pos
+		}
+
+		select {
+		case <-t.ready:
+			return nil
+		case <-ctx.Done():
+			p.release(t)
+			return context.Cause(ctx)
+		case <-tick.C:
+		}
+	}
+}
+
+// release：任务结束（或放弃排队）时归还占位
+func (p *pool) release(t *ticket) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !t.started {
+		for i, q := range p.queue {
+			if q == t {
+				p.queue = append(p.queue[:i], p.queue[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+	p.running--
+	if p.perGroup[t.group]--; p.perGroup[t.group] <= 0 {
+		delete(p.perGroup, t.group)
+	}
+	t.started = false
+	p.dispatch()
+}
+
+// active：已占位运行中的任务数
+func (p *pool) active() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+// queued：当前排队数
+func (p *pool) queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func started(t *ticket) bool {
+	select {
+	case <-t.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPoolDispatch(t *testing.T) {
+	p := newPool(AnsibleCfg{MaxConcurrent: 2, MaxPerHostgroup: 1})
+
+	a1, _ := p.enqueue("a")
+	a2, _ := p.enqueue("a")
+	b1, _ := p.enqueue("b")
+	b2, _ := p.enqueue("b")
+	// hostgroup a 满了不阻塞 b
+	if !started(a1) || started(a2) || !started(b1) || started(b2) {
+		t.Fatalf("started = %v %v %v %v", started(a1), started(a2), started(b1), started(b2))
+	}
+	if p.active() != 2 || p.queued() != 2 || p.position(a2) != 1 || p.position(b2) != 2 {
+		t.Fatalf("active=%d queued=%d pos=%d,%d", p.active(), p.queued(), p.position(a2), p.position(b2))
+	}
+
+	// 释放 b1 后按入队顺序放行：a2 的 hostgroup 仍满，轮到 b2
+	p.release(b1)
+	if started(a2) || !started(b2) {
+		t.Fatalf("after release b1: a2=%v b2=%v", started(a2), started(b2))
+	}
+	p.release(a1)
+	if !started(a2) || p.queued() != 0 || p.active() != 2 {
+		t.Fatalf("after release a1: a2=%v queued=%d active=%d", started(a2), p.queued(), p.active())
+	}
+}
+
+func TestPoolGlobalLimitFIFO(t *testing.T) {
+	p := newPool(AnsibleCfg{MaxConcurrent: 1})
+	t1, _ := p.enqueue("a")
+	t2, _ := p.enqueue("b")
+	t3, _ := p.enqueue("c")
+	p.release(t1)
+	if !started(t2) || started(t3) {
+		t.Fatalf("t2=%v t3=%v", started(t2), started(t3))
+	}
+	// 放弃排队的任务直接出队，不占位
+	p.release(t3)
+	if p.queued() != 0 || p.active() != 1 {
+		t.Fatalf("queued=%d active=%d", p.queued(), p.active())
+	}
+}
+
+func TestPoolQueueFull(t *testing.T) {
+	p := newPool(AnsibleCfg{MaxConcurrent: 1, MaxQueue: 1})
+	p.enqueue("a")
+	if _, err := p.enqueue("a"); err != nil {
+		t.Fatal(err)
+	}
+	if !p.full() {
+		t.Fatal("pool not full")
+	}
+	if _, err := p.enqueue("a"); err != errQueueFull {
+		t.Fatalf("err = %v, want errQueueFull", err)
+	}
+}
+
+func TestPoolSetLimits(t *testing.T) {
+	p := newPool(AnsibleCfg{MaxConcurrent: 1})
+	p.enqueue("a")
+	t2, _ := p.enqueue("a")
+	t3, _ := p.enqueue("b")
+	p.setLimits(AnsibleCfg{MaxConcurrent: 3})
+	if !started(t2) || !started(t3) || p.active() != 3 {
+		t.Fatalf("t2=%v t3=%v active=%d", started(t2), started(t3), p.active())
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// HostRegistry：主机名锁的存储后端
+//
+// 每个 hostname 对应一条记录（Redis 中为 LOCK__<hostname> 哈希），
+// 记录里的 id__ip 字段标识持有者，只有首次写入成功的 ID/IP 才算注册成功。
+type HostRegistry interface {
+	// Lock：hostname 未注册时写入 id__ip 并返回 true；已注册时不覆盖，返回 false
+	Lock(ctx context.Context, hostname, idIP string) (bool, error)
+	// Owner：返回 hostname 当前的 id__ip，未注册返回空串
+	Owner(ctx context.Context, hostname string) (string, error)
+	// Release：删除 hostname 的注册记录
+	Release(ctx context.Context, hostname string) error
+	// ReleaseIf：match 中的字段（不存在的字段视为空串）都和当前记录一致时才删除并返回 true，比较和删除是原子的
+	ReleaseIf(ctx context.Context, hostname string, match map[string]string) (bool, error)
+	// Update：给已注册的 hostname 写入附加字段；未注册时忽略（不会凭空创建记录）
+	Update(ctx context.Context, hostname string, fields map[string]string) error
+	// Replace：hostname 当前的 id__ip 等于 from 时，用 fields（须含 id__ip）整体替换记录并返回 true；否则不修改，返回 false
+	Replace(ctx context.Context, hostname, from string, fields map[string]string) (bool, error)
+	// Get：返回 hostname 的全部字段，未注册返回 nil
+	Get(ctx context.Context, hostname string) (map[string]string, error)
+	// List：返回所有已注册的 hostname
+	List(ctx context.Context) ([]string, error)
+	// AppendHistory：追加一条 hostname 的变更记录，只保留最近 max 条；
+	// 历史保存在锁记录之外（Redis 中为 HISTORY__<hostname> 列表），Release 不会删除
+	AppendHistory(ctx context.Context, hostname, entry string, max int) error
+	// History：hostname 的变更记录，旧的在前
+	History(ctx context.Context, hostname string) ([]string, error)
+	Close() error
+}
+
+const (
+	lockPrefix    = "LOCK__"
+	historyPrefix = "HISTORY__"
+	fieldIDIP     = "id__ip"
+)
+
+// 记录里除 id__ip 外的附加字段
+const (
+	fieldHostgroup    = "hostgroup"
+	fieldPolicy       = "policy"
+	fieldEnv          = "env"
+	fieldIndex        = "index"
+	fieldAddresses    = "addresses"
+	fieldRegisteredAt = "registered_at"
+	fieldLastJob      = "last_job"
+	fieldLastState    = "last_state"
+	fieldLastRunAt    = "last_run_at"
+	fieldLastResult   = "last_result"
+	fieldLastLog      = "last_log"
+	fieldFailedStep   = "failed_step"
+)
+
+// 按配置创建后端：redis（默认）/ file / memory，统一包一层错误计数
+func newRegistry(cfg Config) (HostRegistry, error) {
+	reg, err := openRegistry(cfg)
+	if err != nil {
+		return nil, err
+	}
+	backend := cfg.Registry.Backend
+	if backend == "" {
+		backend = "redis"
+	}
+	return instrumentedRegistry{HostRegistry: reg, backend: backend}, nil
+}
+
+func openRegistry(cfg Config) (HostRegistry, error) {
+	switch cfg.Registry.Backend {
+	case "", "redis":
+		rdb := redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Addr,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+		return &redisRegistry{rdb: rdb}, nil
+	case "file":
+		if cfg.Registry.Path == "" {
+			return nil, errors.New("registry.path is required for file backend")
+		}
+		return openFileRegistry(cfg.Registry.Path)
+	case "memory":
+		return openFileRegistry("")
+	default:
+		return nil, fmt.Errorf("unknown registry backend: %q", cfg.Registry.Backend)
+	}
+}
+
+// redisRegistry：原有实现，HSetNX / HGet / Del 操作 LOCK__<hostname>
+type redisRegistry struct {
+	rdb *redis.Client
+}
+
+func (r *redisRegistry) Lock(ctx context.Context, hostname, idIP string) (bool, error) {
+	return r.rdb.HSetNX(ctx, lockPrefix+hostname, fieldIDIP, idIP).Result()
+}
+
+func (r *redisRegistry) Owner(ctx context.Context, hostname string) (string, error) {
+	v, err := r.rdb.HGet(ctx, lockPrefix+hostname, fieldIDIP).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return v, err
+}
+
+func (r *redisRegistry) Release(ctx context.Context, hostname string) error {
+	return r.rdb.Del(ctx, lockPrefix+hostname).Err()
+}
+
+// 字段都一致时才删除，避免回收和心跳 / 重新注册交错
+var delIfFields = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+for i = 1, #ARGV, 2 do
+	local v = redis.call('HGET', KEYS[1], ARGV[i])
+	if v == false then
+		v = ''
+	end
+	if v ~= ARGV[i + 1] then
+		return 0
+	end
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+func (r *redisRegistry) ReleaseIf(ctx context.Context, hostname string, match map[string]string) (bool, error) {
+	args := make([]any, 0, 2*len(match))
+	for k, v := range match {
+		args = append(args, k, v)
+	}
+	n, err := delIfFields.Run(ctx, r.rdb, []string{lockPrefix + hostname}, args...).Int()
+	return n == 1, err
+}
+
+// 仅当 key 存在时 HSET，避免在 unregister 之后把记录写回来
+var hsetIfExists = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return redis.call('HSET', KEYS[1], unpack(ARGV))
+end
+return 0
+`)
+
+func (r *redisRegistry) Update(ctx context.Context, hostname string, fields map[string]string) error {
+	args := make([]any, 0, 2*len(fields))
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	return hsetIfExists.Run(ctx, r.rdb, []string{lockPrefix + hostname}, args...).Err()
+}
+
+// 持有者不变时整体替换，避免和并发的 register / unregister 交错
+var replaceIfOwner = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'id__ip') == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+	redis.call('HSET', KEYS[1], unpack(ARGV, 2))
+	return 1
+end
+return 0
+`)
+
+func (r *redisRegistry) Replace(ctx context.Context, hostname, from string, fields map[string]string) (bool, error) {
+	args := make([]any, 0, 1+2*len(fields))
+	args = append(args, from)
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	n, err := replaceIfOwner.Run(ctx, r.rdb, []string{lockPrefix + hostname}, args...).Int()
+	return n == 1, err
+}
+
+func (r *redisRegistry) Get(ctx context.Context, hostname string) (map[string]string, error) {
+	m, err := r.rdb.HGetAll(ctx, lockPrefix+hostname).Result()
+	if err != nil || len(m) == 0 {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (r *redisRegistry) List(ctx context.Context) ([]string, error) {
+	var out []string
+	iter := r.rdb.Scan(ctx, 0, lockPrefix+"*", 200).Iterator()
+	for iter.Next(ctx) {
+		out = append(out, strings.TrimPrefix(iter.Val(), lockPrefix))
+	}
+	return out, iter.Err()
+}
+
+func (r *redisRegistry) AppendHistory(ctx context.Context, hostname, entry string, max int) error {
+	key := historyPrefix + hostname
+	_, err := r.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.RPush(ctx, key, entry)
+		p.LTrim(ctx, key, int64(-max), -1)
+		return nil
+	})
+	return err
+}
+
+func (r *redisRegistry) History(ctx context.Context, hostname string) ([]string, error) {
+	return r.rdb.LRange(ctx, historyPrefix+hostname, 0, -1).Result()
+}
+
+func (r *redisRegistry) Close() error {
+	return r.rdb.Close()
+}
+
+// fileRegistry：单机内嵌后端，记录整体保存在一个 JSON 文件里，适合没有 Redis 的实验环境；
+// 变更历史保存在同目录的 <path>.history。path 为空时只保存在内存中（进程重启即丢失）
+type fileRegistry struct {
+	path string
+
+	mu      sync.Mutex
+	hosts   map[string]map[string]string
+	history map[string][]string
+}
+
+func openFileRegistry(path string) (*fileRegistry, error) {
+	r := &fileRegistry{path: path, hosts: make(map[string]map[string]string), history: make(map[string][]string)}
+	if path == "" {
+		return r, nil
+	}
+	if err := readJSONFile(path, &r.hosts); err != nil {
+		return nil, err
+	}
+	if err := readJSONFile(path+".history", &r.history); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// readJSONFile：文件不存在或为空时保持 v 不变
+func readJSONFile(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read registry file: %w", err)
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, v); err != nil {
+			return fmt.Errorf("parse registry file %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (r *fileRegistry) Lock(_ context.Context, hostname, idIP string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rec, ok := r.hosts[hostname]; ok && rec[fieldIDIP] != "" {
+		return false, nil
+	}
+	r.hosts[hostname] = map[string]string{fieldIDIP: idIP}
+	if err := r.flush(); err != nil {
+		delete(r.hosts, hostname)
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *fileRegistry) Owner(_ context.Context, hostname string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hosts[hostname][fieldIDIP], nil
+}
+
+func (r *fileRegistry) Release(_ context.Context, hostname string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.hosts[hostname]
+	if !ok {
+		return nil
+	}
+	delete(r.hosts, hostname)
+	if err := r.flush(); err != nil {
+		r.hosts[hostname] = rec
+		return err
+	}
+	return nil
+}
+
+func (r *fileRegistry) ReleaseIf(_ context.Context, hostname string, match map[string]string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.hosts[hostname]
+	if !ok {
+		return false, nil
+	}
+	for k, v := range match {
+		if rec[k] != v {
+			return false, nil
+		}
+	}
+	delete(r.hosts, hostname)
+	if err := r.flush(); err != nil {
+		r.hosts[hostname] = rec
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *fileRegistry) Update(_ context.Context, hostname string, fields map[string]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.hosts[hostname]
+	if !ok {
+		return nil
+	}
+	old := maps.Clone(rec)
+	maps.Copy(rec, fields)
+	if err := r.flush(); err != nil {
+		r.hosts[hostname] = old
+		return err
+	}
+	return nil
+}
+
+func (r *fileRegistry) Replace(_ context.Context, hostname, from string, fields map[string]string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.hosts[hostname]
+	if !ok || rec[fieldIDIP] != from {
+		return false, nil
+	}
+	r.hosts[hostname] = maps.Clone(fields)
+	if err := r.flush(); err != nil {
+		r.hosts[hostname] = rec
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *fileRegistry) Get(_ context.Context, hostname string) (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return maps.Clone(r.hosts[hostname]), nil
+}
+
+func (r *fileRegistry) List(_ context.Context) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Collect(maps.Keys(r.hosts)), nil
+}
+
+func (r *fileRegistry) AppendHistory(_ context.Context, hostname, entry string, max int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.history[hostname]
+	h := append(slices.Clone(old), entry)
+	if len(h) > max {
+		h = h[len(h)-max:]
+	}
+	r.history[hostname] = h
+	if r.path == "" {
+		return nil
+	}
+	if err := writeJSONFile(r.path+".history", r.history); err != nil {
+		r.history[hostname] = old
+		return err
+	}
+	return nil
+}
+
+func (r *fileRegistry) History(_ context.Context, hostname string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.history[hostname]), nil
+}
+
+func (r *fileRegistry) Close() error {
+	return nil
+}
+
+// flush：整体重写数据文件，调用方持锁
+func (r *fileRegistry) flush() error {
+	if r.path == "" {
+		return nil
+	}
+	return writeJSONFile(r.path, r.hosts)
+}
+
+// writeJSONFile：先写临时文件再 rename
+func writeJSONFile(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("mkdir registry dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("write registry file: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileRegistryLock(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "registry.json")
+	r, err := openFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := r.Lock(ctx, "prod-web-001", "biz-a__10.0.0.1"); err != nil || !ok {
+		t.Fatalf("first lock: ok=%v err=%v", ok, err)
+	}
+	// 已注册时不覆盖
+	if ok, err := r.Lock(ctx, "prod-web-001", "biz-b__10.0.0.2"); err != nil || ok {
+		t.Fatalf("second lock: ok=%v err=%v", ok, err)
+	}
+	if owner, _ := r.Owner(ctx, "prod-web-001"); owner != "biz-a__10.0.0.1" {
+		t.Fatalf("owner = %q", owner)
+	}
+
+	// Update 只更新已注册的记录
+	if err := r.Update(ctx, "prod-web-001", map[string]string{fieldHostgroup: "prod-web"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Update(ctx, "prod-web-002", map[string]string{fieldHostgroup: "prod-web"}); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := r.Get(ctx, "prod-web-002"); f != nil {
+		t.Fatalf("update created record: %v", f)
+	}
+
+	// 重新打开后数据仍在
+	r2, err := openFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := r2.Get(ctx, "prod-web-001")
+	if f[fieldIDIP] != "biz-a__10.0.0.1" || f[fieldHostgroup] != "prod-web" {
+		t.Fatalf("reopened record = %v", f)
+	}
+
+	if err := r2.Release(ctx, "prod-web-001"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := r2.Lock(ctx, "prod-web-001", "biz-b__10.0.0.2"); !ok {
+		t.Fatal("lock after release failed")
+	}
+}
+
+func TestOpenRegistry(t *testing.T) {
+	tests := []struct {
+		backend, path string
+		wantErr       bool
+	}{
+		{"", "", false}, // redis 连接延迟到第一次请求
+		{"redis", "", false},
+		{"memory", "", false},
+		{"file", filepath.Join(t.TempDir(), "registry.json"), false},
+		{"file", "", true},
+		{"etcd", "", true},
+	}
+	for _, tt := range tests {
+		_, err := openRegistry(Config{Registry: RegistryCfg{Backend: tt.backend, Path: tt.path}})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("openRegistry(%q, %q) err = %v", tt.backend, tt.path, err)
+		}
+	}
+}
+
+func TestFileRegistryReleaseIf(t *testing.T) {
+	ctx := context.Background()
+	r, _ := openFileRegistry("")
+	r.Lock(ctx, "prod-web-001", "biz-a__10.0.0.1")
+	r.Update(ctx, "prod-web-001", map[string]string{fieldLastSeen: "t1"})
+
+	// 不存在的字段按空串比较
+	if ok, _ := r.ReleaseIf(ctx, "prod-web-001", map[string]string{fieldIDIP: "biz-a__10.0.0.1", fieldLastSeen: "t0"}); ok {
+		t.Fatal("released with stale last_seen")
+	}
+	if ok, _ := r.ReleaseIf(ctx, "prod-web-001", map[string]string{fieldIDIP: "biz-a__10.0.0.1", fieldLastRunAt: "t1"}); ok {
+		t.Fatal("released with missing field mismatch")
+	}
+	ok, err := r.ReleaseIf(ctx, "prod-web-001", map[string]string{fieldIDIP: "biz-a__10.0.0.1", fieldLastSeen: "t1", fieldLastRunAt: ""})
+	if err != nil || !ok {
+		t.Fatalf("release: ok=%v err=%v", ok, err)
+	}
+	if owner, _ := r.Owner(ctx, "prod-web-001"); owner != "" {
+		t.Fatalf("owner after release = %q", owner)
+	}
+}
+
+func TestFileRegistryReplace(t *testing.T) {
+	ctx := context.Background()
+	r, _ := openFileRegistry("")
+	if ok, err := r.Replace(ctx, "prod-web-001", "", map[string]string{fieldIDIP: "biz-b__10.0.0.2"}); err != nil || ok {
+		t.Fatalf("replace unregistered: ok=%v err=%v", ok, err)
+	}
+
+	r.Lock(ctx, "prod-web-001", "biz-a__10.0.0.1")
+	r.Update(ctx, "prod-web-001", map[string]string{fieldLastJob: "job-1"})
+
+	if ok, _ := r.Replace(ctx, "prod-web-001", "biz-x__10.0.0.9", map[string]string{fieldIDIP: "biz-b__10.0.0.2"}); ok {
+		t.Fatal("replace with wrong owner succeeded")
+	}
+	ok, err := r.Replace(ctx, "prod-web-001", "biz-a__10.0.0.1", map[string]string{fieldIDIP: "biz-b__10.0.0.2", fieldHostgroup: "prod-web"})
+	if err != nil || !ok {
+		t.Fatalf("replace: ok=%v err=%v", ok, err)
+	}
+	// 整体替换：旧字段不保留
+	f, _ := r.Get(ctx, "prod-web-001")
+	if f[fieldIDIP] != "biz-b__10.0.0.2" || f[fieldLastJob] != "" || f[fieldHostgroup] != "prod-web" {
+		t.Fatalf("record after replace = %v", f)
+	}
+}
+
+func TestFileRegistryHistory(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "registry.json")
+	r, _ := openFileRegistry(path)
+	r.Lock(ctx, "prod-web-001", "biz-a__10.0.0.1")
+	for _, e := range []string{"e1", "e2", "e3"} {
+		if err := r.AppendHistory(ctx, "prod-web-001", e, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 历史不随 Release 删除
+	r.Release(ctx, "prod-web-001")
+
+	r2, err := openFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := r2.History(ctx, "prod-web-001")
+	if len(h) != 2 || h[0] != "e2" || h[1] != "e3" {
+		t.Fatalf("history = %v", h)
+	}
+}
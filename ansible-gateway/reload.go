@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// appState：可热加载的部分，SIGHUP / 管理接口重载时整体替换，新请求使用新配置，
+// 已经在运行的任务不受影响
+type appState struct {
+	cfg    Config
+	reg    HostRegistry
+	naming []*namingPolicy // 编译好的命名规则
+}
+
+// config：当前生效的配置（只读，不要修改）
+func (a *App) config() *Config {
+	return &a.state.Load().cfg
+}
+
+// registry：当前使用的主机名锁后端
+func (a *App) registry() HostRegistry {
+	return a.state.Load().reg
+}
+
+// reload：重新加载配置文件，校验通过后原子替换；失败时保持原配置不变。
+// 返回只有重启才能生效的配置项
+func (a *App) reload() ([]string, error) {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	cfg, err := loadConfig(a.cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	naming, err := compileNaming(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	old := a.state.Load()
+	if cfg.Ansible.StdoutCallback != old.cfg.Ansible.StdoutCallback {
+		if err := checkStdoutCallback(cfg.Ansible.StdoutCallback); err != nil {
+			return nil, err
+		}
+	}
+
+	// 注册表配置变了才重新连接；旧连接延迟关闭，让正在处理的请求用完
+	reg := old.reg
+	rebuild, keepMemory := registryChanged(old.cfg, cfg)
+	if rebuild {
+		if reg, err = newRegistry(cfg); err != nil {
+			return nil, fmt.Errorf("open registry: %w", err)
+		}
+		time.AfterFunc(time.Minute, func() {
+			if err := old.reg.Close(); err != nil {
+				slog.Warn("close old registry failed", "err", err)
+			}
+		})
+	}
+
+	a.state.Store(&appState{cfg: cfg, reg: reg, naming: naming})
+	if err := configureLogger(cfg.Log); err != nil {
+		slog.Error("configure logger failed", "err", err)
+	}
+	a.pool.setLimits(cfg.Ansible)
+	a.batcher.setConfig(cfg.Ansible)
+
+	restart := []string{}
+	if cfg.Server != old.cfg.Server {
+		restart = append(restart, "server")
+	}
+	if cfg.Ansible.Log != old.cfg.Ansible.Log {
+		restart = append(restart, "ansible.log")
+	}
+	if keepMemory {
+		restart = append(restart, "registry")
+	}
+	return restart, nil
+}
+
+func registryBackend(cfg Config) string {
+	if cfg.Registry.Backend == "" {
+		return "redis"
+	}
+	return cfg.Registry.Backend
+}
+
+// registryChanged：后端类型变了，或当前后端自己的配置变了（redis 看 redis 段，file 看 registry.path）时需要重建。
+// memory 后端的数据只在进程内，重建即丢失全部锁，因此从不重建：切换到其它后端返回 keepMemory，需要重启生效
+func registryChanged(old, cfg Config) (rebuild, keepMemory bool) {
+	from, to := registryBackend(old), registryBackend(cfg)
+	switch {
+	case from == "memory":
+		return false, to != "memory"
+	case from != to:
+		return true, false
+	case to == "redis":
+		return cfg.Redis != old.Redis, false
+	case to == "file":
+		return cfg.Registry.Path != old.Registry.Path, false
+	}
+	return false, false
+}
+
+// handleReload：收到 SIGHUP 时重新加载配置
+func (a *App) handleReload() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		a.logReload(a.reload())
+	}
+}
+
+func (a *App) logReload(restart []string, err error) {
+	if err != nil {
+		slog.Error("reload config failed, keep running with old config", "config", a.cfgPath, "err", err)
+		return
+	}
+	slog.Info("config reloaded", "config", a.cfgPath)
+	if len(restart) > 0 {
+		slog.Warn("some changes take effect after restart", "restart_required", restart)
+	}
+}
+
+// POST /v1/admin/reload
+func (a *App) reloadConfig(c *gin.Context) {
+	restart, err := a.reload()
+	a.logReload(restart, err)
+	if err != nil {
+		c.String(http.StatusUnprocessableEntity, "reload failed, old config kept:\n%v\n", err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]any{
+		"ok":               true,
+		"config":           a.cfgPath,
+		"restart_required": restart,
+	})
+}
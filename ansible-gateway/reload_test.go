@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRegistryChanged(t *testing.T) {
+	redisA := Config{Redis: RedisCfg{Addr: "10.0.0.1:6379"}}
+	redisB := Config{Redis: RedisCfg{Addr: "10.0.0.2:6379"}}
+	file := func(p string) Config {
+		return Config{Registry: RegistryCfg{Backend: "file", Path: p}, Redis: RedisCfg{Addr: "10.0.0.1:6379"}}
+	}
+	memory := Config{Registry: RegistryCfg{Backend: "memory"}}
+
+	tests := []struct {
+		name                string
+		old, cfg            Config
+		rebuild, keepMemory bool
+	}{
+		{"redis unchanged", redisA, redisA, false, false},
+		{"redis addr", redisA, redisB, true, false},
+		{"redis explicit backend", redisA, Config{Registry: RegistryCfg{Backend: "redis"}, Redis: redisA.Redis}, false, false},
+		// file 后端不关心 redis 段
+		{"file redis changed", file("/a"), Config{Registry: file("/a").Registry, Redis: redisB.Redis}, false, false},
+		{"file path", file("/a"), file("/b"), true, false},
+		{"redis to file", redisA, file("/a"), true, false},
+		// memory 重建会丢失全部锁
+		{"memory unchanged", memory, memory, false, false},
+		{"memory to redis", memory, redisA, false, true},
+		{"redis to memory", redisA, memory, true, false},
+	}
+	for _, tt := range tests {
+		rebuild, keep := registryChanged(tt.old, tt.cfg)
+		if rebuild != tt.rebuild || keep != tt.keepMemory {
+			t.Errorf("%s: rebuild=%v keepMemory=%v", tt.name, rebuild, keep)
+		}
+	}
+}
+
+func TestReloadKeepsLogDir(t *testing.T) {
+	a, _ := newTestApp(t, func(cfg *Config) {
+		cfg.Server.Addr = "127.0.0.1:8080"
+		cfg.Ansible.StdoutCallback = "default"
+	})
+	a.batcher = newBatcher(a.config().Ansible, func(*batch) {})
+	oldLog := a.logDir
+
+	newLog := t.TempDir()
+	a.cfgPath = filepath.Join(t.TempDir(), "config.yaml")
+	conf := "server:\n  addr: 127.0.0.1:8080\n" +
+		"registry:\n  backend: memory\n" +
+		"ansible:\n  dir: " + a.config().Ansible.Dir + "\n  log: " + newLog + "\n  stdout_callback: default\n  max_concurrent: 3\n"
+	if err := os.WriteFile(a.cfgPath, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reg := a.registry()
+
+	restart, err := a.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(restart, "ansible.log") {
+		t.Errorf("restart_required = %v", restart)
+	}
+	// 新配置已生效，但日志目录和 jobStore 一样保持启动时的值
+	if a.config().Ansible.MaxConcurrent != 3 || a.pool.maxRunning != 3 {
+		t.Errorf("max_concurrent not applied")
+	}
+	inv := a.inventoryPath(HostReq{ID: "biz-a", Hostname: "prod-web-001", IP: "10.0.0.1"})
+	if a.logDir != oldLog || filepath.Dir(inv) != oldLog {
+		t.Errorf("log dir moved: logDir=%s inventory=%s", a.logDir, inv)
+	}
+	if p := (&reaper{app: a}).auditPath(); filepath.Dir(p) != oldLog {
+		t.Errorf("reaped audit log = %s", p)
+	}
+	// memory 后端不重建
+	if a.registry() != reg {
+		t.Error("memory registry rebuilt")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 默认使用 ansible.posix 的 jsonl 回调：每个事件一行 JSON，便于边跑边解析
+const defaultStdoutCallback = "ansible.posix.jsonl"
+
+// checkStdoutCallback：启动 / -check-config / 热加载时确认配置的回调已安装。
+// 回调不存在时 ansible-playbook 每次都会失败（如只装了 ansible-core、没装 ansible.posix）
+func checkStdoutCallback(cb string) error {
+	if cb == "" {
+		cb = defaultStdoutCallback
+	}
+	if cb == "default" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ansible-doc", "-t", "callback", "-l").Output()
+	if err != nil {
+		return fmt.Errorf("ansible.stdout_callback: list callback plugins: %w", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) > 0 && (f[0] == cb || f[0] == "ansible.builtin."+cb) {
+			return nil
+		}
+	}
+	return fmt.Errorf("ansible.stdout_callback: callback plugin %s is not installed "+
+		"(install its collection, e.g. ansible-galaxy collection install ansible.posix, or set \"default\")", cb)
+}
+
+// HostRecap：PLAY RECAP 中单台主机的统计
+type HostRecap struct {
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Unreachable int `json:"unreachable"`
+	Failed      int `json:"failed"`
+	Skipped     int `json:"skipped"`
+	Rescued     int `json:"rescued"`
+	Ignored     int `json:"ignored"`
+}
+
+func (r HostRecap) String() string {
+	return fmt.Sprintf("ok=%d changed=%d unreachable=%d failed=%d skipped=%d rescued=%d ignored=%d",
+		r.Ok, r.Changed, r.Unreachable, r.Failed, r.Skipped, r.Rescued, r.Ignored)
+}
+
+// TaskResult：单个 task 在单台主机上的结果
+type TaskResult struct {
+	Play   string `json:"play,omitempty"`
+	Task   string `json:"task"`
+	Host   string `json:"host"`
+	Status string `json:"status"` // ok / changed / failed / unreachable / skipped
+	Msg    string `json:"msg,omitempty"`
+}
+
+// 例：10.1.2.3 : ok=5 changed=2 unreachable=0 failed=0 skipped=1 rescued=0 ignored=0
+var recapLineRe = regexp.MustCompile(`^(\S+)\s+:\s+((?:\w+=\d+\s*)+)$`)
+
+// playbookWriter：透传 ansible-playbook 输出，同时收集结构化结果
+//   - jsonl 回调：解析每行事件，渲染成和默认回调类似的可读行再写给下游
+//   - 默认回调：原样透传，只从 PLAY RECAP 解析每台主机的统计
+//
+// runAndStream 会给每行加 [OUT]/[ERR] 前缀，stdout/stderr 并发写入，需加锁
+type playbookWriter struct {
+	w     io.Writer
+	mu    sync.Mutex
+	buf   []byte
+	in    bool // 默认回调：已进入 PLAY RECAP 段
+	play  string
+	recap map[string]HostRecap
+	tasks []TaskResult
+}
+
+func newPlaybookWriter(w io.Writer) *playbookWriter {
+	return &playbookWriter{w: w, recap: make(map[string]HostRecap)}
+}
+
+func (p *playbookWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		p.line(string(p.buf[:i]))
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+func (p *playbookWriter) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) > 0 {
+		p.line(string(p.buf))
+		p.buf = nil
+	}
+}
+
+func (p *playbookWriter) line(line string) {
+	text, isOut := strings.CutPrefix(line, "[OUT] ")
+	if isOut && strings.HasPrefix(text, "{") {
+		var ev ansibleEvent
+		if err := json.Unmarshal([]byte(text), &ev); err == nil && ev.Event != "" {
+			p.event(&ev)
+			return
+		}
+	}
+
+	fmt.Fprintln(p.w, line)
+	if isOut {
+		p.parseRecap(strings.TrimSpace(text))
+	}
+}
+
+func (p *playbookWriter) out(format string, args ...any) {
+	fmt.Fprintf(p.w, "[OUT] "+format+"\n", args...)
+}
+
+// ansibleEvent：ansible.posix.jsonl 回调输出的一行
+type ansibleEvent struct {
+	Event string `json:"_event"`
+	Play  struct {
+		Name string `json:"name"`
+	} `json:"play"`
+	Task struct {
+		Name string `json:"name"`
+	} `json:"task"`
+	Hosts map[string]json.RawMessage `json:"hosts"`
+	Stats map[string]struct {
+		Ok          int `json:"ok"`
+		Changed     int `json:"changed"`
+		Unreachable int `json:"unreachable"`
+		Failures    int `json:"failures"`
+		Skipped     int `json:"skipped"`
+		Rescued     int `json:"rescued"`
+		Ignored     int `json:"ignored"`
+	} `json:"stats"`
+}
+
+// hostResult：事件里每台主机的结果，只取渲染和统计需要的字段
+type hostResult struct {
+	Changed bool   `json:"changed"`
+	Msg     any    `json:"msg"`
+	Stderr  string `json:"stderr"`
+}
+
+func (r hostResult) message() string {
+	switch m := r.Msg.(type) {
+	case nil:
+	case string:
+		if m != "" {
+			return m
+		}
+	default:
+		b, _ := json.Marshal(m)
+		return string(b)
+	}
+	return r.Stderr
+}
+
+func (p *playbookWriter) event(ev *ansibleEvent) {
+	switch ev.Event {
+	case "v2_playbook_on_play_start":
+		p.play = ev.Play.Name
+		p.out("PLAY [%s] ***", ev.Play.Name)
+
+	case "v2_playbook_on_task_start":
+		p.out("TASK [%s] ***", ev.Task.Name)
+
+	case "v2_runner_on_ok", "v2_runner_on_failed", "v2_runner_on_unreachable", "v2_runner_on_skipped":
+		for host, raw := range ev.Hosts {
+			var r hostResult
+			_ = json.Unmarshal(raw, &r)
+
+			tr := TaskResult{Play: p.play, Task: ev.Task.Name, Host: host}
+			switch ev.Event {
+			case "v2_runner_on_ok":
+				tr.Status = "ok"
+				if r.Changed {
+					tr.Status = "changed"
+				}
+				p.out("%s: [%s]", tr.Status, host)
+			case "v2_runner_on_failed":
+				tr.Status, tr.Msg = "failed", r.message()
+				p.out("fatal: [%s]: FAILED! => %s", host, tr.Msg)
+			case "v2_runner_on_unreachable":
+				tr.Status, tr.Msg = "unreachable", r.message()
+				p.out("fatal: [%s]: UNREACHABLE! => %s", host, tr.Msg)
+			case "v2_runner_on_skipped":
+				tr.Status = "skipped"
+				p.out("skipping: [%s]", host)
+			}
+			p.tasks = append(p.tasks, tr)
+		}
+
+	case "v2_playbook_on_stats":
+		p.out("PLAY RECAP ***")
+		hosts := make([]string, 0, len(ev.Stats))
+		for host := range ev.Stats {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			s := ev.Stats[host]
+			rc := HostRecap{
+				Ok:          s.Ok,
+				Changed:     s.Changed,
+				Unreachable: s.Unreachable,
+				Failed:      s.Failures,
+				Skipped:     s.Skipped,
+				Rescued:     s.Rescued,
+				Ignored:     s.Ignored,
+			}
+			p.recap[host] = rc
+			p.out("%-26s : %s", host, rc)
+		}
+	}
+}
+
+func (p *playbookWriter) parseRecap(line string) {
+	if strings.HasPrefix(line, "PLAY RECAP") {
+		p.in = true
+		return
+	}
+	if !p.in {
+		return
+	}
+	m := recapLineRe.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	var rc HostRecap
+	for _, kv := range strings.Fields(m[2]) {
+		k, v, _ := strings.Cut(kv, "=")
+		n, _ := strconv.Atoi(v)
+		switch k {
+		case "ok":
+			rc.Ok = n
+		case "changed":
+			rc.Changed = n
+		case "unreachable":
+			rc.Unreachable = n
+		case "failed":
+			rc.Failed = n
+		case "skipped":
+			rc.Skipped = n
+		case "rescued":
+			rc.Rescued = n
+		case "ignored":
+			rc.Ignored = n
+		}
+	}
+	p.recap[m[1]] = rc
+}
+
+// hostTasks：取出某台主机的 task 结果
+func (p *playbookWriter) hostTasks(host string) []TaskResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []TaskResult
+	for _, t := range p.tasks {
+		if t.Host == host {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func (p *playbookWriter) hostRecap(host string) (HostRecap, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rc, ok := p.recap[host]
+	return rc, ok
+}
+
+// TaskSummary：按状态统计 task 数
+type TaskSummary struct {
+	Total       int `json:"total"`
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Failed      int `json:"failed"`
+	Unreachable int `json:"unreachable"`
+	Skipped     int `json:"skipped"`
+}
+
+func summarizeTasks(tasks []TaskResult) TaskSummary {
+	s := TaskSummary{Total: len(tasks)}
+	for _, t := range tasks {
+		switch t.Status {
+		case "ok":
+			s.Ok++
+		case "changed":
+			s.Changed++
+		case "failed":
+			s.Failed++
+		case "unreachable":
+			s.Unreachable++
+		case "skipped":
+			s.Skipped++
+		}
+	}
+	return s
+}
+
+func (s TaskSummary) String() string {
+	return fmt.Sprintf("tasks=%d ok=%d changed=%d failed=%d unreachable=%d skipped=%d",
+		s.Total, s.Ok, s.Changed, s.Failed, s.Unreachable, s.Skipped)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlaybookWriterJSONL(t *testing.T) {
+	var out bytes.Buffer
+	p := newPlaybookWriter(&out)
+	lines := []string{
+		`[OUT] {"_event":"v2_playbook_on_play_start","play":{"name":"init"}}`,
+		`[OUT] {"_event":"v2_playbook_on_task_start","task":{"name":"install"}}`,
+		`[OUT] {"_event":"v2_runner_on_ok","task":{"name":"install"},"hosts":{"10.0.0.1":{"changed":true}}}`,
+		`[OUT] {"_event":"v2_playbook_on_task_start","task":{"name":"start"}}`,
+		`[OUT] {"_event":"v2_runner_on_failed","task":{"name":"start"},"hosts":{"10.0.0.1":{"msg":"boom"}}}`,
+		`[ERR] warning`,
+		`[OUT] {"_event":"v2_playbook_on_stats","stats":{"10.0.0.1":{"ok":1,"changed":1,"failures":1}}}`,
+	}
+	// 按任意位置切开写入，模拟管道分块
+	all := strings.Join(lines, "\n")
+	for i := 0; i < len(all); i += 7 {
+		p.Write([]byte(all[i:min(i+7, len(all))]))
+	}
+	p.Close()
+
+	rc, ok := p.hostRecap("10.0.0.1")
+	if !ok || rc != (HostRecap{Ok: 1, Changed: 1, Failed: 1}) {
+		t.Fatalf("recap = %+v, %v", rc, ok)
+	}
+	tasks := p.hostTasks("10.0.0.1")
+	want := []TaskResult{
+		{Play: "init", Task: "install", Host: "10.0.0.1", Status: "changed"},
+		{Play: "init", Task: "start", Host: "10.0.0.1", Status: "failed", Msg: "boom"},
+	}
+	if len(tasks) != len(want) {
+		t.Fatalf("tasks = %+v", tasks)
+	}
+	for i := range want {
+		if tasks[i] != want[i] {
+			t.Errorf("task %d = %+v, want %+v", i, tasks[i], want[i])
+		}
+	}
+	for _, s := range []string{
+		"[OUT] PLAY [init] ***",
+		"[OUT] changed: [10.0.0.1]",
+		"[OUT] fatal: [10.0.0.1]: FAILED! => boom",
+		"[ERR] warning",
+		"[OUT] PLAY RECAP ***",
+	} {
+		if !strings.Contains(out.String(), s+"\n") {
+			t.Errorf("output missing %q:\n%s", s, out.String())
+		}
+	}
+}
+
+func TestPlaybookWriterDefaultRecap(t *testing.T) {
+	var out bytes.Buffer
+	p := newPlaybookWriter(&out)
+	text := "[OUT] TASK [x] ***\n" +
+		"[OUT] 10.0.0.9 : ok=9 changed=9\n" + // PLAY RECAP 之前的行不解析
+		"[OUT] PLAY RECAP *********\n" +
+		"[OUT] 10.0.0.1                   : ok=5 changed=2 unreachable=0 failed=0 skipped=1 rescued=0 ignored=0\n" +
+		"[OUT] 10.0.0.2                   : ok=1 changed=0 unreachable=1 failed=0 skipped=0 rescued=0 ignored=0"
+	p.Write([]byte(text))
+	p.Close()
+
+	if got := out.String(); got != text+"\n" {
+		t.Fatalf("output not passed through:\n%s", got)
+	}
+	if rc, _ := p.hostRecap("10.0.0.1"); rc != (HostRecap{Ok: 5, Changed: 2, Skipped: 1}) {
+		t.Errorf("recap 10.0.0.1 = %+v", rc)
+	}
+	if rc, _ := p.hostRecap("10.0.0.2"); rc != (HostRecap{Ok: 1, Unreachable: 1}) {
+		t.Errorf("recap 10.0.0.2 = %+v", rc)
+	}
+	if _, ok := p.hostRecap("10.0.0.9"); ok {
+		t.Error("parsed recap line outside PLAY RECAP")
+	}
+}
+
+func TestCheckStdoutCallback(t *testing.T) {
+	dir := t.TempDir()
+	doc := "#!/bin/sh\necho 'ansible.builtin.minimal   minimal Ansible screen output'\necho 'community.general.yaml    YAML-ized Ansible screen output'\n"
+	if err := os.WriteFile(filepath.Join(dir, "ansible-doc"), []byte(doc), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	tests := []struct {
+		cb string
+		ok bool
+	}{
+		{"default", true}, // 内置回调不检查
+		{"minimal", true},
+		{"ansible.builtin.minimal", true},
+		{"community.general.yaml", true},
+		{"", false}, // 默认的 ansible.posix.jsonl 未安装
+		{"ansible.posix.jsonl", false},
+	}
+	for _, tt := range tests {
+		if err := checkStdoutCallback(tt.cb); (err == nil) != tt.ok {
+			t.Errorf("checkStdoutCallback(%q) = %v", tt.cb, err)
+		}
+	}
+
+	// 没有 ansible-doc 时同样报错
+	t.Setenv("PATH", t.TempDir())
+	if err := checkStdoutCallback("ansible.posix.jsonl"); err == nil {
+		t.Error("missing ansible-doc accepted")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 注册任务的步骤，记录在 Job.Step 和主机记录的 failed_step 中
+const (
+	stepHostname = "hostname"
+	stepPlaybook = "playbook"
+)
+
+// ansible 有主机不可达时的返回码（TaskQueueManager.RUN_UNREACHABLE_HOSTS）
+const ansibleRCUnreachable = 4
+
+// 自动重试的间隔上限，避免翻倍后过大
+const maxRetryBackoff = 30 * time.Minute
+
+func unreachableExit(err error) bool {
+	var ee *exec.ExitError
+	return errors.As(err, &ee) && ee.ExitCode() == ansibleRCUnreachable
+}
+
+// failedTask：主机最后一个失败 / 不可达的 task（之前的失败可能被 ignore_errors 忽略）
+func failedTask(tasks []TaskResult) string {
+	for i := len(tasks) - 1; i >= 0; i-- {
+		if s := tasks[i].Status; s == "failed" || s == "unreachable" {
+			return tasks[i].Task
+		}
+	}
+	return ""
+}
+
+// autoRetry：主机不可达且还有自动重试次数时，记一次重试并返回等待时间；任务不结束，由 retryLater 重新提交
+func (a *App) autoRetry(j *Job, err error, unreachable bool) (time.Duration, bool) {
+	cfg := a.config().Ansible
+	if !unreachable || errors.Is(err, errShutdown) || cfg.RetryUnreachable <= 0 {
+		return 0, false
+	}
+	snap := j.snapshot()
+	if snap.Attempt >= cfg.RetryUnreachable {
+		j.logf("[WARN] host still unreachable after %d retries", snap.Attempt)
+		return 0, false
+	}
+
+	d := mustDur(cfg.RetryBackoff, 30*time.Second)
+	for i := 0; i < snap.Attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, maxRetryBackoff)
+
+	a.jobs.update(j, func(j *Job) {
+		j.Attempt++
+		j.StartStep = j.Step
+	})
+	metricRetries.WithLabelValues("auto").Inc()
+	j.logf("[WARN] %v; host unreachable, retry %d/%d from %s step in %s", err, snap.Attempt+1, cfg.RetryUnreachable, snap.Step, d)
+	return d, true
+}
+
+// retryLater：等待 d 后把自动重试的任务作为新批次重新提交；网关退出时立即提交，由 runBatch 标记为 interrupted
+func (a *App) retryLater(b *batch, jobs []*Job, d time.Duration) {
+	rb := &batch{hostgroup: b.hostgroup, playbook: b.playbook, jobs: jobs}
+	go func() {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-a.ctx.Done():
+		}
+		a.submitBatch(rb)
+	}()
+}
+
+// RetryReq：POST /v1/host/:hostname/retry 的请求体（可省略）
+type RetryReq struct {
+	StartAtTask    string `json:"StartAtTask,omitempty"`    // 从指定 task 开始执行 playbook（--start-at-task）
+	FromFailedTask bool   `json:"FromFailedTask,omitempty"` // 从上次失败的 task 开始
+}
+
+func validTaskName(s string) bool {
+	if len(s) > 256 {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// retryHost：POST /v1/host/:hostname/retry，上一个任务失败 / 中断时，从失败的步骤重新执行（不重新加锁）
+func (a *App) retryHost(c *gin.Context) {
+	if a.draining.Load() {
+		a.rejectDraining(c)
+		return
+	}
+
+	hostname := c.Param("hostname")
+	if !hostnameCharsRe.MatchString(hostname) {
+		c.String(http.StatusBadRequest, "invalid hostname: %s", hostname)
+		return
+	}
+	ctx := c.Request.Context()
+	f, err := a.registry().Get(ctx, hostname)
+	if err != nil {
+		loggerOf(c).Error("registry get failed", "hostname", hostname, "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
+	if f == nil {
+		c.String(http.StatusNotFound, "host not registered: %s", hostname)
+		return
+	}
+	rec := recordOf(hostname, f)
+	lg := loggerOf(c).With("host_id", rec.ID, "hostname", hostname, "ip", rec.IP, "hostgroup", rec.Hostgroup)
+	c.Set(ctxLogger, lg)
+
+	req := HostReq{ID: rec.ID, Hostname: hostname, IP: rec.IP}
+	if !authorize(c, req, rec.Hostgroup) {
+		return
+	}
+
+	var body RetryReq
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, 1<<20)).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		c.String(http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	if rec.LastJob == "" {
+		c.String(http.StatusConflict, "no previous job for %s", hostname)
+		return
+	}
+	last, err := a.jobs.get(rec.LastJob)
+	if err != nil {
+		lg.Error("load last job failed", "job", rec.LastJob, "err", err)
+		c.String(http.StatusConflict, "previous job %s unavailable: %v", rec.LastJob, err)
+		return
+	}
+	prev := last.snapshot()
+	switch prev.State {
+	case JobFailed, JobInterrupted:
+	case JobSucceeded:
+		c.String(http.StatusConflict, "previous job %s succeeded, nothing to retry", prev.ID)
+		return
+	default:
+		c.String(http.StatusConflict, "previous job %s is still %s", prev.ID, prev.State)
+		return
+	}
+
+	// 没有记录步骤的旧任务从头执行
+	step := prev.Step
+	if step == "" {
+		step = stepHostname
+	}
+	startAt := body.StartAtTask
+	if body.FromFailedTask {
+		if prev.FailedTask == "" {
+			c.String(http.StatusBadRequest, "previous job %s has no failed task recorded", prev.ID)
+			return
+		}
+		startAt = prev.FailedTask
+	}
+	if !validTaskName(startAt) {
+		c.String(http.StatusBadRequest, "invalid task name")
+		return
+	}
+	// 正在执行注销清理：不再重新初始化
+	if _, running := a.teardown.Load(hostname); running {
+		c.String(http.StatusConflict, "teardown of %s is running", hostname)
+		return
+	}
+	audit(c, "retry")
+
+	if a.pool.full() {
+		a.rejectQueueFull(c)
+		return
+	}
+
+	logf, ok := startStream(c)
+	if !ok {
+		return
+	}
+	logf("[INFO] retry %s: previous job %s (%s) stopped at %s step", hostname, prev.ID, prev.State, step)
+
+	// inventory 可能已被清理，按任务信息重写
+	if err := os.WriteFile(prev.Inventory, []byte(hostInventory(prev.Hostgroup, prev.IP)), 0o644); err != nil {
+		logf("[ERROR] write inventory: %v", err)
+		return
+	}
+	job, err := a.jobs.create(
+		HostReq{ID: prev.HostID, Hostname: prev.Hostname, IP: prev.IP, Vars: prev.Vars, Tags: prev.Tags},
+		HostName{Hostgroup: prev.Hostgroup, PlaybookDir: prev.PlaybookDir},
+		prev.Playbook, prev.Inventory, credentialOf(c).name(), requestIDOf(c),
+	)
+	if err != nil {
+		logf("[ERROR] create job: %v", err)
+		return
+	}
+	a.jobs.update(job, func(j *Job) {
+		j.RetryOf = prev.ID
+		j.StartStep = step
+		j.StartAtTask = startAt
+	})
+	metricRetries.WithLabelValues("manual").Inc()
+	if startAt != "" {
+		job.logf("[INFO] playbook starts at task: %s", startAt)
+	}
+	logf("[INFO] job created: %s (status: /v1/jobs/%s, log: /v1/jobs/%s/log)", job.ID, job.ID, job.ID)
+
+	// 重试不参与合并，直接入队
+	a.submitBatch(&batch{hostgroup: job.Hostgroup, playbook: job.Playbook, jobs: []*Job{job}})
+
+	if err := followJob(ctx, job, c.Writer); err != nil {
+		if errors.Is(err, errClientGone) {
+			job.log.Warn("client disconnected, job keeps running")
+			return
+		}
+		job.log.Error("follow job failed", "err", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailedTask(t *testing.T) {
+	tests := []struct {
+		statuses []string
+		want     string
+	}{
+		{nil, ""},
+		{[]string{"ok", "changed", "skipped"}, ""},
+		{[]string{"ok", "failed", "ok"}, "t1"}, // ignore_errors 之后继续执行
+		{[]string{"failed", "ok", "unreachable"}, "t2"},
+	}
+	for _, tt := range tests {
+		var tasks []TaskResult
+		for i, s := range tt.statuses {
+			tasks = append(tasks, TaskResult{Task: "t" + string(rune('0'+i)), Status: s})
+		}
+		if got := failedTask(tasks); got != tt.want {
+			t.Errorf("failedTask(%v) = %q, want %q", tt.statuses, got, tt.want)
+		}
+	}
+}
+
+func TestValidTaskName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"", true},
+		{"install packages : nginx", true},
+		{"安装软件包", true},
+		{"a\nb", false},
+		{"a\x00b", false},
+		{strings.Repeat("x", 257), false},
+	}
+	for _, tt := range tests {
+		if got := validTaskName(tt.name); got != tt.want {
+			t.Errorf("validTaskName(%q) = %v", tt.name, got)
+		}
+	}
+}
+
+func TestAutoRetry(t *testing.T) {
+	a, _ := newTestApp(t, func(cfg *Config) {
+		cfg.Ansible.RetryUnreachable = 3
+		cfg.Ansible.RetryBackoff = "10s"
+	})
+	j := newTestJob(t, a.jobs, "biz-a", "10.0.0.1")
+	a.jobs.update(j, func(j *Job) { j.Step = stepPlaybook })
+	errUnreachable := errors.New("unreachable")
+
+	if _, ok := a.autoRetry(j, errUnreachable, false); ok {
+		t.Fatal("retried a reachable host")
+	}
+	if _, ok := a.autoRetry(j, errShutdown, true); ok {
+		t.Fatal("retried on shutdown")
+	}
+	// 间隔每次翻倍，达到次数上限后不再重试
+	for i, want := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second} {
+		d, ok := a.autoRetry(j, errUnreachable, true)
+		if !ok || d != want {
+			t.Fatalf("retry %d: d=%s ok=%v", i+1, d, ok)
+		}
+	}
+	if _, ok := a.autoRetry(j, errUnreachable, true); ok {
+		t.Fatal("retried past retry_unreachable")
+	}
+	snap := j.snapshot()
+	if snap.Attempt != 3 || snap.StartStep != stepPlaybook {
+		t.Fatalf("attempt=%d start_step=%q", snap.Attempt, snap.StartStep)
+	}
+}
+
+func TestAutoRetryBackoffCap(t *testing.T) {
+	a, _ := newTestApp(t, func(cfg *Config) {
+		cfg.Ansible.RetryUnreachable = 10
+		cfg.Ansible.RetryBackoff = "20m"
+	})
+	j := newTestJob(t, a.jobs, "biz-a", "10.0.0.1")
+	a.jobs.update(j, func(j *Job) { j.Attempt = 5 })
+	if d, ok := a.autoRetry(j, errors.New("unreachable"), true); !ok || d != maxRetryBackoff {
+		t.Fatalf("d=%s ok=%v, want %s", d, ok, maxRetryBackoff)
+	}
+
+	// retry_unreachable 为 0：不自动重试
+	b, _ := newTestApp(t, nil)
+	if _, ok := b.autoRetry(newTestJob(t, b.jobs, "biz-a", "10.0.0.1"), errors.New("unreachable"), true); ok {
+		t.Fatal("retried with retry_unreachable=0")
+	}
+}
+
+func TestRetryHost(t *testing.T) {
+	fakeAnsible(t, `echo "PLAY RECAP ***"
+echo "10.0.0.1 : ok=2 changed=1 unreachable=0 failed=0 skipped=0 rescued=0 ignored=0"`)
+	a, r := newTestApp(t, func(cfg *Config) { cfg.Ansible.StdoutCallback = "default" })
+	r.POST("/v1/host/:hostname/retry", a.retryHost)
+	a.jobs.onState = a.recordJob
+
+	ctx := context.Background()
+	req := HostReq{ID: "biz-a", Hostname: "prod-web-001", IP: "10.0.0.1"}
+	a.registry().Lock(ctx, req.Hostname, "biz-a__10.0.0.1")
+	inv := a.inventoryPath(req)
+	prev, err := a.jobs.create(req, HostName{Hostgroup: "prod-web"}, "prod-web.yml", inv, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.jobs.update(prev, func(j *Job) { j.Step = stepPlaybook })
+	a.jobs.finish(prev, errors.New("exit status 2"))
+
+	// 正在执行注销清理：409，不创建任务
+	a.teardown.Store(req.Hostname, true)
+	w := serve(r, "POST", "/v1/host/prod-web-001/retry", "")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "teardown of prod-web-001 is running") {
+		t.Fatalf("during teardown: code=%d body=%q", w.Code, w.Body.String())
+	}
+	if rec, _ := a.registry().Get(ctx, req.Hostname); rec[fieldLastJob] != prev.ID {
+		t.Fatalf("job created during teardown: %v", rec)
+	}
+	a.teardown.Delete(req.Hostname)
+
+	// 从失败的 playbook 步骤重试
+	os.Remove(inv)
+	w = serve(r, "POST", "/v1/host/prod-web-001/retry", "")
+	if !strings.Contains(w.Body.String(), "previous job "+prev.ID+" (failed) stopped at playbook step") {
+		t.Fatalf("retry: body=%q", w.Body.String())
+	}
+	f, _ := a.registry().Get(ctx, req.Hostname)
+	j, err := a.jobs.get(f[fieldLastJob])
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := j.snapshot()
+	if snap.RetryOf != prev.ID || snap.StartStep != stepPlaybook || snap.State != JobSucceeded {
+		t.Fatalf("retry job: retry_of=%q start_step=%q state=%s err=%q", snap.RetryOf, snap.StartStep, snap.State, snap.Error)
+	}
+	// 已成功的任务不能再重试
+	w = serve(r, "POST", "/v1/host/prod-web-001/retry", "")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "nothing to retry") {
+		t.Fatalf("after success: code=%d body=%q", w.Code, w.Body.String())
+	}
+}
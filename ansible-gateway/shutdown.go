@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errShutdown：网关退出时被中断的任务以此为原因，任务状态记为 interrupted
+var errShutdown = errors.New("interrupted by gateway shutdown")
+
+// shutdown：收到 SIGTERM/SIGINT 后优雅退出
+//  1. 不再接受新的注册（registerHost 返回 503）
+//  2. 等待运行中/排队中的任务结束，最多等 server.shutdown_timeout
+//  3. 超时后取消剩余任务（给 ansible 进程组发 SIGTERM），任务标记为 interrupted
+//  4. 关闭 HTTP 服务和注册表连接
+func (a *App) shutdown(server *http.Server) {
+	a.draining.Store(true)
+
+	timeout := mustDur(a.config().Server.ShutdownTimeout, 5*time.Minute)
+	slog.Info("shutting down: stop accepting registrations", "timeout", timeout.String(), "jobs", a.jobs.count())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err := a.jobs.wait(ctx)
+	cancel()
+	if err != nil {
+		slog.Warn("shutdown timeout, interrupt remaining jobs", "jobs", a.jobs.count())
+		a.cancel(errShutdown)
+
+		// 给被中断的任务一点时间落盘状态
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := a.jobs.wait(ctx); err != nil {
+			slog.Error("jobs did not stop in time", "jobs", a.jobs.count())
+		}
+		cancel()
+	}
+
+	// 任务都结束后，跟随日志的连接会自行返回
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 任务结束的通知还在投递（或等待重试），最多和关闭服务共用这 10 秒
+	if err := a.notifier.wait(ctx); err != nil {
+		slog.Warn("pending notifications dropped")
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("server.Shutdown failed", "err", err)
+	}
+	if err := a.registry().Close(); err != nil {
+		slog.Warn("close registry failed", "err", err)
+	}
+	slog.Info("ansible-gateway stopped")
+}
+
+// rejectDraining：退出过程中拒绝新的注册
+func (a *App) rejectDraining(c *gin.Context) {
+	retry := mustDur(a.config().Ansible.RetryAfter, 30*time.Second)
+	loggerOf(c).Warn("shutting down, reject", "path", c.Request.URL.Path)
+	c.Header("Retry-After", strconv.Itoa(int(retry.Seconds())))
+	c.String(http.StatusServiceUnavailable, "gateway is shutting down, retry after %s", retry)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TakeoverReq：POST /v1/admin/takeover 的请求
+type TakeoverReq struct {
+	Hostname  string     `json:"Hostname"`
+	ID        string     `json:"ID"` // 新的 ID / IP
+	IP        string     `json:"IP"`
+	Addresses []HostAddr `json:"Addresses,omitempty"`
+	Expect    string     `json:"Expect,omitempty"` // 可选：期望的当前持有者 id__ip，不一致时 409
+	Reason    string     `json:"Reason,omitempty"`
+}
+
+// takeover：POST /v1/admin/takeover，把已注册的 hostname 强制改绑到新的 ID/IP（例如主机重建后云主机 ID 变了）。
+// 记录整体替换：旧主机的任务状态不再保留，旧的 ID/IP 记入主机名历史；之后新主机用新 ID/IP 调用 register 执行初始化
+func (a *App) takeover(c *gin.Context) {
+	var in TakeoverReq
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, 1<<20)).Decode(&in); err != nil {
+		c.String(http.StatusBadRequest, "invalid json")
+		return
+	}
+	req := HostReq{ID: in.ID, Hostname: in.Hostname, IP: in.IP, Addresses: in.Addresses}
+	if err := validate(&req); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(in.Reason) > 256 || strings.ContainsFunc(in.Reason, func(r rune) bool { return r < 0x20 }) {
+		c.String(http.StatusBadRequest, "invalid reason")
+		return
+	}
+	name, err := a.parseName(req.ID, req.Hostname)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	lg := loggerOf(c).With("host_id", req.ID, "hostname", req.Hostname, "ip", req.IP, "hostgroup", name.Hostgroup)
+	c.Set(ctxLogger, lg)
+
+	ctx := c.Request.Context()
+	f, err := a.registry().Get(ctx, req.Hostname)
+	if err != nil {
+		metricTakeovers.WithLabelValues("registry_error").Inc()
+		lg.Error("registry get failed", "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
+	if f == nil {
+		c.String(http.StatusNotFound, "host not registered: %s (register it directly)", req.Hostname)
+		return
+	}
+	rec := recordOf(req.Hostname, f)
+	stored := f[fieldIDIP]
+	val := req.ID + "__" + req.IP
+	if in.Expect != "" && in.Expect != stored {
+		metricTakeovers.WithLabelValues("conflict").Inc()
+		c.String(http.StatusConflict, "owner changed: stored=%q expect=%q", stored, in.Expect)
+		return
+	}
+	if stored == val {
+		metricTakeovers.WithLabelValues("unchanged").Inc()
+		c.JSON(http.StatusOK, map[string]any{"ok": true, "hostname": req.Hostname, "changed": false})
+		return
+	}
+	// 旧主机的任务还在跑时不改绑，先等任务结束或退出网关
+	if rec.LastJob != "" {
+		if j, err := a.jobs.get(rec.LastJob); err == nil && !j.finished() {
+			c.String(http.StatusConflict, "job %s is still running for %s", rec.LastJob, stored)
+			return
+		}
+	}
+	audit(c, "takeover")
+
+	fields := registrationFields(req, name)
+	fields[fieldIDIP] = val
+
+	ok, err := a.registry().Replace(ctx, req.Hostname, stored, fields)
+	if err != nil {
+		metricTakeovers.WithLabelValues("registry_error").Inc()
+		lg.Error("registry replace failed", "err", err)
+		c.String(http.StatusInternalServerError, "registry error: "+err.Error())
+		return
+	}
+	if !ok {
+		metricTakeovers.WithLabelValues("conflict").Inc()
+		c.String(http.StatusConflict, "owner of %s changed during takeover, retry", req.Hostname)
+		return
+	}
+	metricTakeovers.WithLabelValues("takeover").Inc()
+	lg.Warn("takeover ok", "previous", stored, "reason", in.Reason)
+	a.recordHistory(ctx, req.Hostname, HistoryEntry{
+		Action:    historyTakeover,
+		ID:        req.ID,
+		IP:        req.IP,
+		Hostgroup: name.Hostgroup,
+		PrevID:    rec.ID,
+		PrevIP:    rec.IP,
+		By:        credentialOf(c).name(),
+		Reason:    in.Reason,
+		RequestID: requestIDOf(c),
+	})
+
+	f, _ = a.registry().Get(ctx, req.Hostname)
+	c.JSON(http.StatusOK, map[string]any{
+		"ok":       true,
+		"changed":  true,
+		"previous": stored,
+		"record":   recordOf(req.Hostname, f),
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// releaseHost：释放主机名锁，outcome 记入注销指标（released / forced）并发送 unregister 通知
+func (a *App) releaseHost(ctx context.Context, c *gin.Context, req HostReq, hostgroup, outcome string) error {
+	lg := loggerOf(c)
+	if err := a.registry().Release(ctx, req.Hostname); err != nil {
+		metricUnregistrations.WithLabelValues("registry_error").Inc()
+		lg.Error("registry release failed", "err", err)
+		return err
+	}
+	metricUnregistrations.WithLabelValues(outcome).Inc()
+	lg.Info("unregister ok", "key", lockPrefix+req.Hostname, "outcome", outcome)
+	a.recordHistory(ctx, req.Hostname, HistoryEntry{
+		Action: historyUnregister, ID: req.ID, IP: req.IP, Hostgroup: hostgroup,
+		By: credentialOf(c).name(), Outcome: outcome, RequestID: requestIDOf(c),
+	})
+	a.notifier.send(Event{
+		Event: eventUnregister, Hostname: req.Hostname, ID: req.ID, IP: req.IP, Hostgroup: hostgroup,
+		Outcome: outcome, Credential: credentialOf(c).name(), RequestID: requestIDOf(c),
+	})
+	return nil
+}
+
+// teeFlusher：同时写客户端和清理日志文件，每次写完立即 flush；客户端断开后只写文件
+type teeFlusher struct {
+	mu sync.Mutex
+	w  gin.ResponseWriter
+	f  *os.File
+}
+
+func (t *teeFlusher) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, _ = t.f.Write(p)
+	if _, err := t.w.Write(p); err == nil {
+		t.w.Flush()
+	}
+	return len(p), nil
+}
+
+// unregisterWithTeardown：执行 <hostgroup>.teardown.yml（查找顺序同 selectPlaybook）并流式输出，
+// 成功后释放锁；失败时保留锁，force=true 时仍然释放。清理在网关的根 context 下运行，客户端断开不会中断
+func (a *App) unregisterWithTeardown(c *gin.Context, req HostReq, name HostName, force bool) {
+	lg := loggerOf(c)
+	if a.draining.Load() {
+		a.rejectDraining(c)
+		return
+	}
+	if a.pool.full() {
+		a.rejectQueueFull(c)
+		return
+	}
+	// 注册任务还在运行时不清理，避免初始化和清理 playbook 同时跑
+	if j := a.jobs.activeFor(req.Hostname); j != nil {
+		c.String(http.StatusConflict, "job %s is still running for %s", j.ID, req.Hostname)
+		return
+	}
+	if _, running := a.teardown.LoadOrStore(req.Hostname, true); running {
+		c.String(http.StatusConflict, "teardown of %s is already running", req.Hostname)
+		return
+	}
+	defer a.teardown.Delete(req.Hostname)
+	// 退出时和注册任务一样等待清理结束，超时后随根 context 取消
+	defer a.jobs.hold()()
+
+	if err := os.MkdirAll(a.logDir, 0o755); err != nil {
+		lg.Error("mkdir log dir failed", "err", err)
+		c.String(http.StatusInternalServerError, "mkdir log_dir: "+err.Error())
+		return
+	}
+	logPath := filepath.Join(a.logDir, fmt.Sprintf("%s__%s__%s__teardown__%s.log",
+		req.ID, req.Hostname, req.IP, time.Now().Format("2006-01-02_15:04:05.000000")))
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		lg.Error("open teardown log failed", "err", err)
+		c.String(http.StatusInternalServerError, "open teardown log: "+err.Error())
+		return
+	}
+	defer f.Close()
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	out := &teeFlusher{w: w, f: f}
+	logf := func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		logLine(lg, msg)
+		fmt.Fprintf(out, "%s %s\n", time.Now().Format("2006/01/02 15:04:05.000000"), msg)
+	}
+
+	logf("[INFO] teardown %s (force=%t), log=%s", req.Hostname, force, logPath)
+	err = a.teardownStep(a.ctx, req, name, out, logf)
+	outcome := "released"
+	switch {
+	case err == nil:
+		logf("[INFO] teardown done")
+	case force:
+		outcome = "forced"
+		logf("[WARN] teardown failed, force release: %v", err)
+	default:
+		metricUnregistrations.WithLabelValues("teardown_failed").Inc()
+		logf("[ERROR] teardown failed, lock kept (retry, or use force=true to release anyway): %v", err)
+		return
+	}
+
+	// 清理可能跑了很久，释放前再确认锁仍属于这台主机
+	ctx := context.WithoutCancel(c.Request.Context())
+	if stored, err := a.registry().Owner(ctx, req.Hostname); err != nil || stored != req.ID+"__"+req.IP {
+		logf("[ERROR] lock changed during teardown (stored=%q, err=%v), not released", stored, err)
+		return
+	}
+	if err := a.releaseHost(ctx, c, req, name.Hostgroup, outcome); err != nil {
+		logf("[ERROR] registry release failed: %v", err)
+		return
+	}
+	logf("[INFO] unregistered: %s%s", lockPrefix, req.Hostname)
+}
+
+// teardownStep：选清理 playbook、写 inventory、排队后执行，按 PLAY RECAP 判断本机结果
+func (a *App) teardownStep(ctx context.Context, req HostReq, name HostName, w *teeFlusher, logf func(string, ...any)) error {
+	playbook, warn, err := selectTeardown(name.PlaybookDir, name.Hostgroup)
+	if warn != "" {
+		logf("[WARN] %s", warn)
+	}
+	if err != nil {
+		return err
+	}
+	logf("[INFO] use teardown playbook: %s", playbook)
+
+	inv := a.inventoryPath(req)
+	if err := os.WriteFile(inv, []byte(hostInventory(name.Hostgroup, req.IP)), 0o644); err != nil {
+		return fmt.Errorf("write inventory: %w", err)
+	}
+
+	t, err := a.pool.enqueue(name.Hostgroup)
+	if err != nil {
+		return err
+	}
+	defer a.pool.release(t)
+	if err := a.pool.wait(ctx, t, func(pos, queued int) {
+		logf("[INFO] queued: position %d/%d", pos, queued)
+	}); err != nil {
+		return err
+	}
+
+	cmd, err := a.playbookCommand(playbookRun{
+		Dir:       name.PlaybookDir,
+		Playbook:  playbook,
+		Inventory: inv,
+		Hostgroup: name.Hostgroup,
+	})
+	if err != nil {
+		return err
+	}
+	pw := newPlaybookWriter(w)
+	runErr := a.runAndStream(ctx, cmd, pw, logf)
+	pw.Close()
+
+	rc, ok := pw.hostRecap(req.IP)
+	if ok {
+		logf("[INFO] host result: %s", rc)
+	}
+	switch {
+	case ok && (rc.Failed > 0 || rc.Unreachable > 0):
+		return fmt.Errorf("host failed (failed=%d, unreachable=%d)", rc.Failed, rc.Unreachable)
+	case runErr != nil:
+		return runErr
+	case !ok:
+		return fmt.Errorf("host missing from PLAY RECAP")
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReleaseHost(t *testing.T) {
+	a, _ := newTestApp(t, nil)
+	ctx := context.Background()
+	req := HostReq{ID: "biz-a", Hostname: "prod-web-001", IP: "10.0.0.1"}
+	a.registry().Lock(ctx, req.Hostname, "biz-a__10.0.0.1")
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/host/unregister", nil)
+	if err := a.releaseHost(ctx, c, req, "prod-web", "forced"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := a.registry().Owner(ctx, req.Hostname); owner != "" {
+		t.Fatalf("owner after release = %q", owner)
+	}
+	h, err := a.hostHistory(ctx, req.Hostname)
+	if err != nil || len(h) != 1 || h[0].Action != historyUnregister || h[0].Outcome != "forced" || h[0].Hostgroup != "prod-web" {
+		t.Fatalf("history = %+v (err %v)", h, err)
+	}
+}
+
+// 清理 playbook：TEARDOWN_FAIL 非空时本机失败
+const teardownScript = `if [ -n "$TEARDOWN_FAIL" ]; then
+echo "10.0.0.1 : ok=1 changed=0 unreachable=0 failed=1 skipped=0 rescued=0 ignored=0"
+exit 2
+fi
+echo "10.0.0.1 : ok=2 changed=1 unreachable=0 failed=0 skipped=0 rescued=0 ignored=0"`
+
+func TestUnregisterWithTeardown(t *testing.T) {
+	fakeAnsible(t, "echo 'PLAY RECAP ***'\n"+teardownScript)
+	a, r := newTestApp(t, func(cfg *Config) { cfg.Ansible.StdoutCallback = "default" })
+	ctx := context.Background()
+	dir := a.config().Ansible.Dir
+	if err := os.WriteFile(filepath.Join(dir, "prod-web.teardown.yml"), []byte("- hosts: all\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"ID":"biz-a","Hostname":"prod-web-001","IP":"10.0.0.1"}`
+	owner := func() string {
+		o, _ := a.registry().Owner(ctx, "prod-web-001")
+		return o
+	}
+	a.registry().Lock(ctx, "prod-web-001", "biz-a__10.0.0.1")
+
+	// 注册任务还在运行 / 已有清理在运行：409
+	j := newTestJob(t, a.jobs, "biz-a", "10.0.0.1")
+	w := serve(r, "POST", "/v1/host/unregister?teardown=true", body)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "job "+j.ID+" is still running") {
+		t.Fatalf("active job: code=%d body=%q", w.Code, w.Body.String())
+	}
+	a.jobs.finish(j, nil)
+	a.teardown.Store("prod-web-001", true)
+	w = serve(r, "POST", "/v1/host/unregister?teardown=true", body)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "teardown of prod-web-001 is already running") {
+		t.Fatalf("concurrent teardown: code=%d body=%q", w.Code, w.Body.String())
+	}
+	a.teardown.Delete("prod-web-001")
+
+	// 清理失败：保留锁
+	t.Setenv("TEARDOWN_FAIL", "1")
+	w = serve(r, "POST", "/v1/host/unregister?teardown=true", body)
+	if !strings.Contains(w.Body.String(), "teardown failed, lock kept") || owner() != "biz-a__10.0.0.1" {
+		t.Fatalf("failed teardown: owner=%q body=%q", owner(), w.Body.String())
+	}
+	if logs, _ := filepath.Glob(filepath.Join(a.logDir, "*__teardown__*.log")); len(logs) != 1 {
+		t.Fatalf("teardown logs = %v", logs)
+	}
+
+	// force=true：清理失败也释放
+	w = serve(r, "POST", "/v1/host/unregister?teardown=true&force=true", body)
+	if !strings.Contains(w.Body.String(), "force release") || owner() != "" {
+		t.Fatalf("forced: owner=%q body=%q", owner(), w.Body.String())
+	}
+	h, _ := a.hostHistory(ctx, "prod-web-001")
+	if len(h) != 1 || h[0].Outcome != "forced" {
+		t.Fatalf("history = %+v", h)
+	}
+
+	// 清理成功：正常释放
+	t.Setenv("TEARDOWN_FAIL", "")
+	a.registry().Lock(ctx, "prod-web-001", "biz-a__10.0.0.1")
+	w = serve(r, "POST", "/v1/host/unregister?teardown=true", body)
+	if !strings.Contains(w.Body.String(), "teardown done") || owner() != "" {
+		t.Fatalf("teardown: owner=%q body=%q", owner(), w.Body.String())
+	}
+	if h, _ := a.hostHistory(ctx, "prod-web-001"); len(h) != 2 || h[1].Outcome != "released" {
+		t.Fatalf("history = %+v", h)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RequestVarsRule：允许注册请求携带的 extra vars / tags。hostgroups / vars / tags 均为 path.Match 通配，
+// 一个 hostgroup 匹配多条规则时取并集；没有规则匹配的 hostgroup 不允许携带任何变量和 tag
+type RequestVarsRule struct {
+	Hostgroups []string `yaml:"hostgroups"`
+	Vars       []string `yaml:"vars"`
+	Tags       []string `yaml:"tags"`
+}
+
+const maxVarValueLen = 4096
+
+var (
+	varNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	tagRe     = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+)
+
+// 只在模式列表非空时才可能允许（和 matchAny 的“空 = 不限制”相反）
+func allowedBy(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequestVars：按 hostgroup 的允许列表校验请求里的 extra vars / tags
+func checkRequestVars(rules []RequestVarsRule, hostgroup string, vars map[string]any, tags []string) error {
+	if len(vars) == 0 && len(tags) == 0 {
+		return nil
+	}
+	var allowVars, allowTags []string
+	for _, r := range rules {
+		if allowedBy(r.Hostgroups, hostgroup) {
+			allowVars = append(allowVars, r.Vars...)
+			allowTags = append(allowTags, r.Tags...)
+		}
+	}
+
+	names := make([]string, 0, len(vars))
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		// hosts 由网关传入；ansible_* 可以改连接方式 / 提权，一律不允许
+		if !varNameRe.MatchString(k) || k == "hosts" || strings.HasPrefix(k, "ansible_") {
+			return fmt.Errorf("invalid var name: %q", k)
+		}
+		if !allowedBy(allowVars, k) {
+			return fmt.Errorf("var %q is not allowed for hostgroup %s", k, hostgroup)
+		}
+		switch v := vars[k].(type) {
+		case string:
+			if len(v) > maxVarValueLen {
+				return fmt.Errorf("var %q is too long", k)
+			}
+		case json.Number, float64, bool:
+		default:
+			return fmt.Errorf("var %q must be a string, number or bool", k)
+		}
+	}
+	for _, t := range tags {
+		if !tagRe.MatchString(t) {
+			return fmt.Errorf("invalid tag: %q", t)
+		}
+		if !allowedBy(allowTags, t) {
+			return fmt.Errorf("tag %q is not allowed for hostgroup %s", t, hostgroup)
+		}
+	}
+	return nil
+}
+
+// varsKey：合并运行时，extra vars / tags 不同的任务不能放进同一批
+func varsKey(vars map[string]any, tags []string) string {
+	if len(vars) == 0 && len(tags) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(vars) // map 按 key 排序输出，结果稳定
+	return string(b) + "\x00" + strings.Join(tags, ",")
+}
+
+// validateRequestVars：配置中的通配模式必须合法
+func validateRequestVars(rules []RequestVarsRule) []error {
+	var errs []error
+	for i, r := range rules {
+		for _, list := range [][]string{r.Hostgroups, r.Vars, r.Tags} {
+			for _, p := range list {
+				if _, err := path.Match(p, ""); err != nil {
+					errs = append(errs, fmt.Errorf("ansible.request_vars[%d]: invalid pattern %q", i, p))
+				}
+			}
+		}
+	}
+	return errs
+}
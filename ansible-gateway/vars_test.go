@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCheckRequestVars(t *testing.T) {
+	rules := []RequestVarsRule{
+		{Hostgroups: []string{"prod-goods-*"}, Vars: []string{"app_version"}, Tags: []string{"base"}},
+		{Hostgroups: []string{"prod-goods-api"}, Vars: []string{"feature_*"}, Tags: []string{"app"}},
+	}
+	tests := []struct {
+		hostgroup string
+		vars      map[string]any
+		tags      []string
+		err       string
+	}{
+		{"order-api", nil, nil, ""}, // 不带变量时不检查
+		{"prod-goods-ms", map[string]any{"app_version": "1.2"}, []string{"base"}, ""},
+		// 多条规则匹配时取并集
+		{"prod-goods-api", map[string]any{"app_version": json.Number("3"), "feature_x": true}, []string{"base", "app"}, ""},
+		{"prod-goods-ms", map[string]any{"feature_x": true}, nil, `var "feature_x" is not allowed for hostgroup prod-goods-ms`},
+		{"prod-goods-ms", nil, []string{"app"}, `tag "app" is not allowed`},
+		{"order-api", map[string]any{"app_version": "1"}, nil, "is not allowed for hostgroup order-api"},
+		{"prod-goods-ms", map[string]any{"hosts": "all"}, nil, `invalid var name: "hosts"`},
+		{"prod-goods-ms", map[string]any{"ansible_user": "root"}, nil, "invalid var name"},
+		{"prod-goods-ms", map[string]any{"app-version": "1"}, nil, "invalid var name"},
+		{"prod-goods-ms", map[string]any{"app_version": []any{"1"}}, nil, "must be a string, number or bool"},
+		{"prod-goods-ms", map[string]any{"app_version": strings.Repeat("x", maxVarValueLen+1)}, nil, "too long"},
+		{"prod-goods-ms", nil, []string{"base,app"}, "invalid tag"},
+	}
+	for _, tt := range tests {
+		err := checkRequestVars(rules, tt.hostgroup, tt.vars, tt.tags)
+		if (err == nil) != (tt.err == "") || (err != nil && !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("checkRequestVars(%s, %v, %v) = %v, want %q", tt.hostgroup, tt.vars, tt.tags, err, tt.err)
+		}
+	}
+}
+
+func TestVarsKey(t *testing.T) {
+	a := varsKey(map[string]any{"b": 1, "a": "x"}, []string{"base"})
+	b := varsKey(map[string]any{"a": "x", "b": 1}, []string{"base"})
+	if a != b {
+		t.Errorf("varsKey not stable: %q != %q", a, b)
+	}
+	if varsKey(nil, nil) != "" || a == varsKey(map[string]any{"a": "x", "b": 1}, []string{"app"}) {
+		t.Error("varsKey does not separate tags")
+	}
+}
+
+func TestValidateRequestVars(t *testing.T) {
+	errs := validateRequestVars([]RequestVarsRule{{Hostgroups: []string{"prod-*"}}, {Vars: []string{"[a-"}}})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "ansible.request_vars[1]") {
+		t.Errorf("errs = %v", errs)
+	}
+}
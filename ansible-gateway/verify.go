@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// 注册方身份校验
+//   - source：请求源地址（经过可信代理时取 X-Forwarded-For 中的客户端地址）必须等于管理地址 req.IP
+//   - token：请求带的 Token 必须等于 hex(HMAC-SHA256(bootstrap_secret, "<hostname>__<ip>"))，
+//     由创建主机的一方（如 cloud-init 模板）预先算好写进主机
+type VerifyCfg struct {
+	Mode                string   `yaml:"mode"`                  // "" 不校验 / "source" / "token"
+	TrustedProxies      []string `yaml:"trusted_proxies"`       // 可信代理，IP 或 CIDR
+	BootstrapSecret     string   `yaml:"bootstrap_secret"`      // token 模式的密钥
+	BootstrapSecretFile string   `yaml:"bootstrap_secret_file"` // 从文件读取密钥
+}
+
+// parsePrefixes：解析 IP / CIDR 列表
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q: %w", s, err)
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip %q: %w", s, err)
+		}
+		addr = addr.Unmap()
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
+
+func inPrefixes(addr netip.Addr, list []netip.Prefix) bool {
+	for _, p := range list {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr：请求的真实来源地址。直连地址是可信代理时，从 X-Forwarded-For 右往左跳过可信代理，
+// 第一个不可信的地址即客户端；直连地址不可信时忽略 X-Forwarded-For（防伪造）
+func clientAddr(r *http.Request, trusted []netip.Prefix) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote addr %q", r.RemoteAddr)
+	}
+	addr = addr.Unmap()
+	if !inPrefixes(addr, trusted) {
+		return addr, nil
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hops = append(hops, h)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid X-Forwarded-For entry %q", hops[i])
+		}
+		addr = hop.Unmap()
+		if !inPrefixes(addr, trusted) {
+			break
+		}
+	}
+	return addr, nil
+}
+
+// bootstrapToken：token 模式下主机应携带的 token
+func bootstrapToken(secret, hostname, ip string) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(hostname + "__" + ip))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// verifyCaller：按配置校验注册方就是被注册的主机，校验不通过返回原因
+func (a *App) verifyCaller(r *http.Request, req HostReq) error {
+	v := a.config().Verify
+	switch v.Mode {
+	case "":
+		return nil
+
+	case "source":
+		trusted, err := parsePrefixes(v.TrustedProxies)
+		if err != nil {
+			return fmt.Errorf("verify.trusted_proxies: %w", err)
+		}
+		src, err := clientAddr(r, trusted)
+		if err != nil {
+			return err
+		}
+		// 只和管理地址比较：附加地址由调用方自己上报，不能用来证明身份
+		if ip, err := netip.ParseAddr(req.IP); err == nil && src == ip.Unmap() {
+			return nil
+		}
+		return fmt.Errorf("source address %s does not match ip %s", src, req.IP)
+
+	case "token":
+		if req.Token == "" {
+			return fmt.Errorf("missing bootstrap token")
+		}
+		want := bootstrapToken(v.BootstrapSecret, req.Hostname, req.IP)
+		if !hmac.Equal([]byte(want), []byte(req.Token)) {
+			return fmt.Errorf("bootstrap token does not match %s/%s", req.Hostname, req.IP)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown verify.mode: %q", v.Mode)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	trusted, err := parsePrefixes([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote, xff string
+		want        string
+		wantErr     bool
+	}{
+		// 直连地址不可信：忽略 X-Forwarded-For
+		{"172.16.0.5:1234", "1.2.3.4", "172.16.0.5", false},
+		{"10.0.0.1:1234", "", "10.0.0.1", false},
+		{"10.0.0.1:1234", "1.2.3.4", "1.2.3.4", false},
+		// 从右往左跳过可信代理，伪造的最左项不生效
+		{"10.0.0.1:1234", "6.6.6.6, 1.2.3.4, 192.168.1.1", "1.2.3.4", false},
+		// 全部是可信代理时取最左项
+		{"10.0.0.1:1234", "192.168.1.2, 192.168.1.1", "192.168.1.2", false},
+		{"10.0.0.1:1234", "1.2.3.4, bad", "", true},
+		{"[::ffff:172.16.0.5]:1234", "", "172.16.0.5", false},
+		{"[::ffff:10.0.0.1]:1234", "::ffff:1.2.3.4", "1.2.3.4", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/v1/host/register", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		got, err := clientAddr(r, trusted)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("clientAddr(%s, %q) err = %v", tt.remote, tt.xff, err)
+			continue
+		}
+		if !tt.wantErr && got.String() != tt.want {
+			t.Errorf("clientAddr(%s, %q) = %s, want %s", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyCallerToken(t *testing.T) {
+	a := &App{}
+	a.state.Store(&appState{cfg: Config{Verify: VerifyCfg{Mode: "token", BootstrapSecret: "boot"}}})
+	good := bootstrapToken("boot", "prod-web-001", "10.0.0.1")
+
+	tests := []struct {
+		hostname, ip, token string
+		ok                  bool
+	}{
+		{"prod-web-001", "10.0.0.1", good, true},
+		{"prod-web-001", "10.0.0.1", "", false},
+		{"prod-web-001", "10.0.0.1", bootstrapToken("other", "prod-web-001", "10.0.0.1"), false},
+		// token 绑定 hostname 和 IP，不能拿去注册别的主机
+		{"prod-web-002", "10.0.0.1", good, false},
+		{"prod-web-001", "10.0.0.2", good, false},
+	}
+	for _, tt := range tests {
+		req := HostReq{Hostname: tt.hostname, IP: tt.ip, Token: tt.token}
+		r := httptest.NewRequest("POST", "/v1/host/register", nil)
+		if err := a.verifyCaller(r, req); (err == nil) != tt.ok {
+			t.Errorf("verifyCaller(%s, %s, %q) = %v", tt.hostname, tt.ip, tt.token, err)
+		}
+	}
+}
+
+func TestVerifyCallerSource(t *testing.T) {
+	a := &App{}
+	a.state.Store(&appState{cfg: Config{Verify: VerifyCfg{Mode: "source"}}})
+
+	req := HostReq{Hostname: "prod-web-001", IP: "10.0.0.1", Addresses: []HostAddr{{Name: "service", IP: "10.0.1.1"}}}
+	r := httptest.NewRequest("POST", "/v1/host/register", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	if err := a.verifyCaller(r, req); err != nil {
+		t.Errorf("mgmt ip: %v", err)
+	}
+	// 附加地址由调用方自报，不能用来通过校验
+	r.RemoteAddr = "10.0.1.1:1234"
+	if err := a.verifyCaller(r, req); err == nil {
+		t.Error("additional address passed source verification")
+	}
+}